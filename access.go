@@ -0,0 +1,140 @@
+/* General Web framework
+ * access log in Combined or JSON lines format
+ * Qujie Tech 2019-08-16
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// supported access log formats
+const (
+	AccessFmtCombined = "combined"
+	AccessFmtJSON     = "json"
+)
+
+// access log time format of Combined
+const accessTimeFmt = "02/Jan/2006:15:04:05 -0700"
+
+// access record of a request
+type accessRecord struct {
+	start     time.Time
+	remote    string
+	method    string
+	uri       string
+	proto     string
+	status    int
+	bytes     int64
+	duration  time.Duration
+	userAgent string
+	referer   string
+	requestID string
+}
+
+// JSON line of access record
+type accessJSON struct {
+	Time      string  `json:"time"`
+	Remote    string  `json:"remote"`
+	Method    string  `json:"method"`
+	URI       string  `json:"uri"`
+	Proto     string  `json:"proto"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration_ms"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	Referer   string  `json:"referer,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
+}
+
+// access logger in instance
+type accessLogger struct {
+	format string
+	sender func(level QLogLevel, msg string)
+}
+
+// instance which write access logs
+type accessLogInstance interface {
+	accessLog(rec *accessRecord)
+}
+
+// check access log format
+func checkAccessFmt(format string) error {
+	switch format {
+	case "", AccessFmtCombined, AccessFmtJSON:
+		return nil
+	}
+	return fmt.Errorf("unsupported access log format %q", format)
+}
+
+// quote field of Combined format, '-' for empty
+func accessQuote(s string) string {
+	if s == "" {
+		return "\"-\""
+	}
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	return "\"" + strings.Replace(s, "\"", "\\\"", -1) + "\""
+}
+
+// host part of remote address
+func accessHost(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	if remote == "" {
+		return "-"
+	}
+	return remote
+}
+
+//////////////////// accessRecord methods ////////////////////
+
+// accessRecord: Apache Combined format with request ID and duration
+// (microsecond) at the end
+func (rec *accessRecord) combined() string {
+	size := "-"
+	if rec.bytes > 0 {
+		size = strconv.FormatInt(rec.bytes, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s %s %d",
+		accessHost(rec.remote), rec.start.Format(accessTimeFmt),
+		accessQuote(rec.method+" "+rec.uri+" "+rec.proto), rec.status, size,
+		accessQuote(rec.referer), accessQuote(rec.userAgent),
+		accessQuote(rec.requestID), rec.duration/time.Microsecond)
+}
+
+// accessRecord: JSON line
+func (rec *accessRecord) jsonLine() string {
+	ret, err := json.Marshal(&accessJSON{
+		rec.start.Format(time.RFC3339Nano),
+		accessHost(rec.remote),
+		rec.method,
+		rec.uri,
+		rec.proto,
+		rec.status,
+		rec.bytes,
+		float64(rec.duration) / float64(time.Millisecond),
+		rec.userAgent,
+		rec.referer,
+		rec.requestID,
+	})
+	if err != nil {
+		return "{}"
+	}
+	return string(ret)
+}
+
+// accessRecord: format record
+func (rec *accessRecord) format(format string) string {
+	if format == AccessFmtJSON {
+		return rec.jsonLine()
+	}
+	return rec.combined()
+}
@@ -0,0 +1,328 @@
+/* General Web framework
+ * bind request data to struct
+ * Qujie Tech 2019-08-21
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sources of bind tags, in order of binding
+var bindSources = []string{"path", "query", "header", "cookie", "form"}
+
+// types with special conversion
+var (
+	bindTimeType     = reflect.TypeOf(time.Time{})
+	bindDurationType = reflect.TypeOf(time.Duration(0))
+	bindTextType     = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// BindFieldError is a failed field in request binding
+type BindFieldError struct {
+	Field  string // struct field path
+	Source string // source of value: path, query, header, cookie, form, body
+	Name   string // name in source
+	Value  string // failed value
+	Err    error  // reason
+}
+
+// BindError is error of request binding, it list every failed field. it is
+// responded as 400 by framework
+type BindError struct {
+	Fields []*BindFieldError
+}
+
+// value getter of a source
+type bindGetter func(name string) []string
+
+// check media type of body
+func bindMediaType(req SvrReq) (string, map[string]string) {
+	ctype := req.Header().Get("Content-Type")
+	if ctype == "" {
+		return "", nil
+	}
+	media, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return "", nil
+	}
+	return media, params
+}
+
+// convert a string to value
+func bindScalar(fv reflect.Value, s string, layout string) error {
+	if fv.Kind() == reflect.Ptr {
+		nv := reflect.New(fv.Type().Elem())
+		if err := bindScalar(nv.Elem(), s, layout); err != nil {
+			return err
+		}
+		fv.Set(nv)
+		return nil
+	}
+	switch {
+	case fv.Type() == bindTimeType:
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		tm, err := time.Parse(layout, s)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(tm))
+		return nil
+	case fv.Type() == bindDurationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	case reflect.PtrTo(fv.Type()).Implements(bindTextType):
+		return fv.Addr().Interface().(encoding.TextUnmarshaler).
+			UnmarshalText([]byte(s))
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
+
+// convert values to field. slice field accept all values
+func bindValues(fv reflect.Value, vals []string, layout string) (
+	string, error) {
+	if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 &&
+		!reflect.PtrTo(fv.Type()).Implements(bindTextType) {
+		sl := reflect.MakeSlice(fv.Type(), len(vals), len(vals))
+		for i, s := range vals {
+			if err := bindScalar(sl.Index(i), s, layout); err != nil {
+				return s, err
+			}
+		}
+		fv.Set(sl)
+		return "", nil
+	}
+	if fv.Kind() == reflect.Slice { // []byte
+		fv.SetBytes([]byte(vals[0]))
+		return "", nil
+	}
+	return vals[0], bindScalar(fv, vals[0], layout)
+}
+
+// bind tagged fields of struct
+func bindStruct(rv reflect.Value, prefix string,
+	getters map[string]bindGetter, berr *BindError) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		fv := rv.Field(i)
+		if sf.PkgPath != "" && !sf.Anonymous { // unexported
+			continue
+		}
+		tagged := false
+		for _, src := range bindSources {
+			name, ok := sf.Tag.Lookup(src)
+			if !ok {
+				continue
+			}
+			tagged = true
+			if name = strings.Split(name, ",")[0]; name == "-" {
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+			vals := getters[src](name)
+			if len(vals) == 0 {
+				continue
+			}
+			if failed, err := bindValues(
+				fv, vals, sf.Tag.Get("time_format")); err != nil {
+				berr.Fields = append(berr.Fields, &BindFieldError{
+					prefix + sf.Name, src, name, failed, err})
+			}
+		}
+		// embedded struct
+		if !tagged && sf.Anonymous {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct {
+				if fv.IsNil() {
+					if !fv.CanSet() {
+						continue
+					}
+					fv.Set(reflect.New(ft.Elem()))
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				bindStruct(fv, prefix+sf.Name+".", getters, berr)
+			}
+		}
+	}
+}
+
+//////////////////// BindError methods ////////////////////
+
+// BindError: field errors as problem details extension
+func (e *BindError) problemExt() map[string]interface{} {
+	fields := make([]map[string]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		fields = append(fields, map[string]string{
+			"field": f.Field, "source": f.Source, "name": f.Name,
+			"message": f.Err.Error(),
+		})
+	}
+	return map[string]interface{}{"errors": fields}
+}
+
+// BindError: error message
+func (e *BindError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Error())
+	}
+	return "bind request failed: " + strings.Join(msgs, "; ")
+}
+
+// BindError: bad request
+func (e *BindError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// BindFieldError: error message
+func (e *BindFieldError) Error() string {
+	if e.Source == "body" {
+		return fmt.Sprintf("body: %s", e.Err)
+	}
+	return fmt.Sprintf("%s(%s %q): %s", e.Field, e.Source, e.Name, e.Err)
+}
+
+//////////////////// svrRspObj binding ////////////////////
+
+// check body is available for binding
+func (srq *svrRspObj) bindBodyAvailable() bool {
+	return !srq.mrkReaded || srq.rawContent != nil || srq.postform != nil ||
+		srq.upload != nil
+}
+
+// decode body by `Content-Type`. JSON body is decoded to dst directly, form
+// values are returned for `form` tags
+func (srq *svrRspObj) bindBody(dst interface{}) (url.Values, error) {
+	if srq.postform != nil {
+		return srq.postform, nil
+	}
+	if srq.readErr != nil {
+		return nil, srq.readErr
+	}
+	if srq.ContentLength() == 0 || !srq.bindBodyAvailable() {
+		return nil, nil
+	}
+	media, params := bindMediaType(srq)
+	switch {
+	case media == "application/json" || strings.HasSuffix(media, "+json"):
+		return nil, srq.ReadBodyJSON(dst)
+	case media == "application/x-www-form-urlencoded":
+		return srq.ReadBodyForm()
+	case media == "multipart/form-data" && params["boundary"] != "":
+		upload, err := srq.ReadUpload(nil)
+		if err != nil {
+			return nil, err
+		}
+		srq.postform = upload.Values
+		return upload.Values, nil
+	}
+	return nil, nil
+}
+
+// bind request data to struct which dst point to. body is decoded by
+// `Content-Type` first (JSON, URI form or multipart form), then fields are
+// set by tags `path`, `query`, `header`, `cookie` and `form`. error is
+// *BindError if any field failed. bound struct is checked by `validate` tags
+// at last, and error is *ValidateError if validate failed. multipart form is
+// read by ReadUpload with default limits, so files are available by calling
+// ReadUpload after Bind
+func (srq *svrRspObj) Bind(dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() ||
+		rv.Elem().Kind() != reflect.Struct {
+		return errors.New("bind target must be a pointer to struct")
+	}
+	berr := &BindError{}
+	form, err := srq.bindBody(dst)
+	if err != nil {
+		var sterr statusCoder
+		if errors.As(err, &sterr) &&
+			sterr.StatusCode() != http.StatusBadRequest {
+			return err // for example 413 of body or upload
+		}
+		berr.Fields = append(berr.Fields,
+			&BindFieldError{"", "body", "", "", err})
+	}
+	query := srq.Query()
+	getters := map[string]bindGetter{
+		"path": func(name string) []string {
+			if val, ok := srq.params[name]; ok {
+				return []string{val}
+			}
+			return nil
+		},
+		"query": func(name string) []string {
+			return query[name]
+		},
+		"header": func(name string) []string {
+			return srq.Header()[http.CanonicalHeaderKey(name)]
+		},
+		"cookie": func(name string) []string {
+			if coo, err := srq.Cookie(name); err == nil {
+				return []string{coo.Value}
+			}
+			return nil
+		},
+		"form": func(name string) []string {
+			return form[name]
+		},
+	}
+	bindStruct(rv.Elem(), "", getters, berr)
+	if len(berr.Fields) > 0 {
+		return berr
+	}
+	return Validate(dst)
+}
@@ -0,0 +1,145 @@
+/* General Web framework
+ * tests of request binding
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// embedded fields of bind test
+type bindTestPage struct {
+	Page int `query:"page"`
+}
+
+// target of bind test
+type bindTestTarget struct {
+	bindTestPage
+	ID      int64         `path:"id"`
+	Tags    []string      `query:"tag"`
+	Since   time.Time     `query:"since" time_format:"2006-01-02"`
+	Timeout time.Duration `header:"X-Timeout"`
+	Token   *string       `header:"X-Token"`
+	Session string        `cookie:"sid"`
+	Name    string        `form:"name" json:"name"`
+	Enabled bool          `form:"enabled" json:"enabled"`
+	Ignored string        `query:"-"`
+}
+
+// create request object for binding, path parameter `id` is 42
+func newBindTestReq(method, target, ctype, body string) SvrReq {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	req.Header.Set("X-Timeout", "1500ms")
+	req.Header.Set("X-Token", "secret")
+	req.AddCookie(&http.Cookie{Name: "sid", Value: "s1"})
+	srq := createReqObj(newTestInstance(), httptest.NewRecorder(), req)
+	srq.setPathParam("id", "42")
+	return srq
+}
+
+func TestBindSources(t *testing.T) {
+	for _, c := range []struct{ ctype, body string }{
+		{"application/x-www-form-urlencoded", "name=bob&enabled=true"},
+		{"application/json", `{"name":"bob","enabled":true}`},
+	} {
+		srq := newBindTestReq("POST",
+			"/item/42?page=3&tag=a&tag=b&since=2019-09-01&Ignored=x",
+			c.ctype, c.body)
+		var dst bindTestTarget
+		if err := srq.Bind(&dst); err != nil {
+			t.Fatalf("%s: %v", c.ctype, err)
+		}
+		since, _ := time.Parse("2006-01-02", "2019-09-01")
+		if dst.ID != 42 || dst.Page != 3 ||
+			!reflect.DeepEqual(dst.Tags, []string{"a", "b"}) ||
+			!dst.Since.Equal(since) || dst.Timeout != 1500*time.Millisecond ||
+			dst.Token == nil || *dst.Token != "secret" || dst.Session != "s1" ||
+			dst.Name != "bob" || !dst.Enabled || dst.Ignored != "" {
+			t.Fatalf("%s: bound %+v", c.ctype, dst)
+		}
+	}
+}
+
+func TestBindTypeErrors(t *testing.T) {
+	srq := newBindTestReq("GET", "/item/42?page=x&since=yesterday", "", "")
+	srq.setPathParam("id", "abc")
+	var dst bindTestTarget
+	err := srq.Bind(&dst)
+	berr, ok := err.(*BindError)
+	if !ok {
+		t.Fatalf("error %T %v", err, err)
+	}
+	got := make([]string, 0)
+	for _, f := range berr.Fields {
+		got = append(got, f.Source+":"+f.Field)
+	}
+	want := []string{"query:bindTestPage.Page", "path:ID", "query:Since"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("fields %v", got)
+	}
+	srq = newBindTestReq("POST", "/", "application/json", "{bad json")
+	if err := srq.Bind(&dst); err == nil {
+		t.Fatal("bad JSON accepted")
+	} else if f := err.(*BindError).Fields[0]; f.Source != "body" {
+		t.Fatalf("field %+v", f)
+	}
+	if err := srq.Bind(dst); err == nil {
+		t.Fatal("non-pointer target accepted")
+	}
+}
+
+// session which bind request in EnterServer
+type bindTestSession struct {
+	textTestSession
+	req SvrReq
+}
+
+// bindTestSession: bind request
+func (ses *bindTestSession) EnterServer() (string, error) {
+	var dst bindTestTarget
+	return "", ses.req.Bind(&dst)
+}
+
+func TestBindErrorStatus(t *testing.T) {
+	_, hnd := newTestHandler(CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			return &bindTestSession{textTestSession{"ok"}, req}
+		}))
+	rec := serveTest(hnd, "GET", "/?page=x", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec = serveTest(hnd, "GET", "/?page=2", nil); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+}
+
+func TestBindRouteParam(t *testing.T) {
+	rte := CreatePathHandle()
+	rte.Handle("/item/:id", CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			var dst struct {
+				ID int `path:"id"`
+			}
+			if err := req.Bind(&dst); err != nil {
+				return &textTestSession{err.Error()}
+			}
+			return &textTestSession{strconv.Itoa(dst.ID)}
+		}))
+	_, hnd := newTestHandler(rte)
+	if rec := serveTest(hnd, "GET", "/item/7", nil); rec.Body.String() != "7" {
+		t.Fatalf("body %q", rec.Body.String())
+	}
+}
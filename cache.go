@@ -0,0 +1,342 @@
+/* General Web framework
+ * in-memory response cache handle
+ * Qujie Tech 2019-08-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default options of cache handle
+const (
+	cacheDefaultTTL    = 60 * time.Second
+	cacheDefaultMemory = 67108864
+)
+
+// cacheable response status
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// CacheConf defined options of response cache handle
+type CacheConf struct {
+	TTL          time.Duration // default fresh time without `max-age`
+	MaxMemory    int64         // max memory of cached responses
+	StaleRefresh time.Duration // stale-while-revalidate time
+	VaryHeaders  []string      // request headers as a part of cache key
+}
+
+// cached response entry
+type cacheEntry struct {
+	key        string
+	rsp        *recordRsp
+	size       int64
+	created    time.Time
+	expire     time.Time // fresh until
+	staleLimit time.Time // stale response available until
+	refreshing bool      // mark refresh in background
+	public     bool      // response can be shared with credentials
+}
+
+// in-memory LRU cache
+type rspCache struct {
+	lock    sync.Mutex
+	conf    CacheConf
+	entries map[string]*list.Element
+	lru     *list.List // front is recently used
+	memory  int64
+}
+
+// cache handle decorator, it implement QHandle
+type cacheHandle struct {
+	inst  QInstance
+	hnd   QHandle
+	cache *rspCache
+}
+
+// instance which manage response caches
+type cacheRegister interface {
+	regCache(cache *rspCache)
+}
+
+// caches list in instance
+type cacheRegistry struct {
+	lock   sync.Mutex
+	caches []*rspCache
+}
+
+// CreateCacheHandle create a handle which cache complete responses of hnd in
+// memory. cache key is begin with request path and query, so it can be purged
+// by path prefix through QInstance.PurgeCache. request with `Authorization`
+// or `Cookie` only use responses marked `public` or `s-maxage`, so private
+// pages are not shared to other clients. conf can be nil for default
+func CreateCacheHandle(hnd QHandle, conf *CacheConf) QHandle {
+	cache := &rspCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if conf != nil {
+		cache.conf = *conf
+	}
+	if cache.conf.TTL <= 0 {
+		cache.conf.TTL = cacheDefaultTTL
+	}
+	if cache.conf.MaxMemory <= 0 {
+		cache.conf.MaxMemory = cacheDefaultMemory
+	}
+	return &cacheHandle{nil, hnd, cache}
+}
+
+// check request carry credentials of client
+func hasCredentials(req SvrReq) bool {
+	return req.Header().Get("Authorization") != "" ||
+		req.Header().Get("Cookie") != ""
+}
+
+// parse freshness from `Cache-Control` of response. store is false if the
+// response must not be cached, public is true if it can be shared with
+// credentials
+func cacheFreshness(header http.Header, def time.Duration) (
+	ttl time.Duration, swr time.Duration, store bool, public bool) {
+	ttl, swr, store = def, -1, true
+	smaxage := false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		name := strings.ToLower(kv[0])
+		switch name {
+		case "no-store", "no-cache", "private":
+			store = false
+		case "public":
+			public = true
+		case "max-age", "s-maxage", "stale-while-revalidate":
+			if len(kv) != 2 {
+				continue
+			}
+			sec, err := strconv.ParseInt(strings.Trim(kv[1], "\""), 10, 64)
+			if err != nil || sec < 0 {
+				continue
+			}
+			switch {
+			case name == "stale-while-revalidate":
+				swr = time.Duration(sec) * time.Second
+			case name == "s-maxage":
+				ttl, smaxage = time.Duration(sec)*time.Second, true
+				public = true
+			case !smaxage:
+				ttl = time.Duration(sec) * time.Second
+			}
+		}
+	}
+	if len(header["Set-Cookie"]) > 0 || ttl <= 0 {
+		store = false
+	}
+	return
+}
+
+//////////////////// cacheRegistry methods ////////////////////
+
+// add cache to registry
+func (reg *cacheRegistry) add(cache *rspCache) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.caches = append(reg.caches, cache)
+}
+
+// purge entries in all caches by key prefix
+func (reg *cacheRegistry) purge(prefix string) int {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	count := 0
+	for _, cache := range reg.caches {
+		count += cache.purge(prefix)
+	}
+	return count
+}
+
+//////////////////// rspCache methods ////////////////////
+
+// rspCache: make cache key for request. host is a part of key because
+// response may refer it, for example absolute redirect
+func (cache *rspCache) key(req SvrReq) string {
+	buf := &strings.Builder{}
+	buf.WriteString(req.FullPath())
+	if req.RawQuery() != "" {
+		buf.WriteString("?" + req.RawQuery())
+	}
+	buf.WriteString("\x00" + req.Method())
+	buf.WriteString("\x00" + strings.ToLower(req.HostName()))
+	for _, name := range cache.conf.VaryHeaders {
+		fmt.Fprintf(buf, "\x00%s:%s", http.CanonicalHeaderKey(name),
+			strings.Join(req.Header()[http.CanonicalHeaderKey(name)], ","))
+	}
+	return buf.String()
+}
+
+// rspCache: get entry, cred is true for request with credentials. refresh is
+// true if caller should refresh stale entry
+func (cache *rspCache) get(key string, cred bool) (
+	ent *cacheEntry, refresh bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	elem, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	ent = elem.Value.(*cacheEntry)
+	if cred && !ent.public {
+		return nil, false
+	}
+	now := time.Now()
+	if now.Before(ent.expire) {
+		cache.lru.MoveToFront(elem)
+		return ent, false
+	}
+	if now.Before(ent.staleLimit) {
+		cache.lru.MoveToFront(elem)
+		refresh = !ent.refreshing
+		ent.refreshing = true
+		return ent, refresh
+	}
+	cache.removeElem(elem)
+	return nil, false
+}
+
+// rspCache: store response if it is cacheable, cred is true for request with
+// credentials
+func (cache *rspCache) put(key string, rsp *recordRsp, cred bool) {
+	if !cacheableStatus[rsp.status] {
+		cache.release(key)
+		return
+	}
+	ttl, swr, store, public := cacheFreshness(rsp.header, cache.conf.TTL)
+	if !store || (cred && !public) {
+		cache.release(key)
+		return
+	}
+	if swr < 0 {
+		swr = cache.conf.StaleRefresh
+	}
+	size := int64(len(key) + len(rsp.body))
+	for k, v := range rsp.header {
+		size += int64(len(k))
+		for _, s := range v {
+			size += int64(len(s))
+		}
+	}
+	if size > cache.conf.MaxMemory {
+		cache.release(key)
+		return
+	}
+	now := time.Now()
+	ent := &cacheEntry{
+		key, rsp, size, now, now.Add(ttl), now.Add(ttl + swr), false, public}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		cache.removeElem(elem)
+	}
+	cache.entries[key] = cache.lru.PushFront(ent)
+	cache.memory += size
+	for cache.memory > cache.conf.MaxMemory {
+		cache.removeElem(cache.lru.Back())
+	}
+}
+
+// rspCache: reset refreshing mark when refresh failed
+func (cache *rspCache) release(key string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		elem.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+// rspCache: remove entry, lock must be held
+func (cache *rspCache) removeElem(elem *list.Element) {
+	ent := cache.lru.Remove(elem).(*cacheEntry)
+	delete(cache.entries, ent.key)
+	cache.memory -= ent.size
+}
+
+// rspCache: remove entries by key prefix
+func (cache *rspCache) purge(prefix string) int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	count := 0
+	for key, elem := range cache.entries {
+		if strings.HasPrefix(key, prefix) {
+			cache.removeElem(elem)
+			count++
+		}
+	}
+	return count
+}
+
+//////////////////// cacheHandle methods ////////////////////
+
+// cacheHandle: init inner handle and register cache to instance
+func (hnd *cacheHandle) InitHandler(
+	inst QInstance, rte RouteHandle, ptree *RouteTree) {
+	hnd.inst = inst
+	if reg, ok := inst.(cacheRegister); ok {
+		reg.regCache(hnd.cache)
+	}
+	hnd.hnd.InitHandler(inst, rte, ptree)
+}
+
+// cacheHandle: refresh stale entry in background with a copy of request.
+// path parameters, values and env of request are kept
+func (hnd *cacheHandle) refresh(key string, req SvrReq, env interface{}) {
+	cred := hasCredentials(req)
+	rawreq := req.RawReq().Clone(context.Background())
+	rawreq.Body = http.NoBody
+	rawreq.ContentLength = 0
+	subreq := req.cloneReq(newRspRecorder(), rawreq)
+	go (func() {
+		defer (func() {
+			if err := recover(); err != nil {
+				hnd.cache.release(key)
+			}
+		})()
+		rsp, err := runCaptured(hnd.hnd, subreq, env)
+		if err != nil {
+			hnd.cache.release(key)
+			return
+		}
+		hnd.cache.put(key, rsp, cred)
+	})()
+}
+
+// cacheHandle: serve from cache or record response of inner handle
+func (hnd *cacheHandle) BeginSession(req SvrReq, env interface{}) QSession {
+	if req.Method() != MethodGET && req.Method() != MethodHEAD {
+		return hnd.hnd.BeginSession(req, env)
+	}
+	key, cred := hnd.cache.key(req), hasCredentials(req)
+	if ent, refresh := hnd.cache.get(key, cred); ent != nil {
+		if refresh {
+			hnd.refresh(key, req, env)
+		}
+		age := int64(time.Since(ent.created) / time.Second)
+		return &replaySession{ent.rsp, http.Header{
+			"Age": []string{strconv.FormatInt(age, 10)},
+		}}
+	}
+	return beginCapture(hnd.hnd, req, env, func(rsp *recordRsp) {
+		hnd.cache.put(key, rsp, cred)
+	})
+}
@@ -0,0 +1,197 @@
+/* General Web framework
+ * tests of response cache handle
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// session responding text with extra headers
+type headerTestSession struct {
+	textTestSession
+	header http.Header
+}
+
+// headerTestSession: header
+func (ses *headerTestSession) BeginResponse(header http.Header) int {
+	for k, v := range ses.header {
+		header[k] = v
+	}
+	return ses.textTestSession.BeginResponse(header)
+}
+
+// create cache handler which count sessions of inner handle
+func newCacheTestHandler(count *int32, conf *CacheConf,
+	create func(req SvrReq) QSession) (*svrInstance, http.HandlerFunc) {
+	return newTestHandler(CreateCacheHandle(CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			atomic.AddInt32(count, 1)
+			return create(req)
+		}), conf))
+}
+
+// serve a request of handler and get response
+func serveTest(hnd http.HandlerFunc, method, target string,
+	header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	hnd(rec, req)
+	return rec
+}
+
+func TestCacheCredentials(t *testing.T) {
+	var count int32
+	_, hnd := newCacheTestHandler(&count, nil, func(req SvrReq) QSession {
+		return &textTestSession{"user " + req.Header().Get("Cookie")}
+	})
+	cookie := http.Header{"Cookie": []string{"sid=1"}}
+	serveTest(hnd, "GET", "/page", cookie)
+	rec := serveTest(hnd, "GET", "/page", nil)
+	if count != 2 || rec.Body.String() != "user " {
+		t.Fatalf("credentialed response shared, count %d, body %q",
+			count, rec.Body.String())
+	}
+	rec = serveTest(hnd, "GET", "/page", cookie)
+	if count != 3 || rec.Body.String() != "user sid=1" {
+		t.Fatalf("anonymous response served with credentials, count %d", count)
+	}
+	auth := http.Header{"Authorization": []string{"Bearer x"}}
+	serveTest(hnd, "GET", "/page", auth)
+	if count != 4 {
+		t.Fatalf("anonymous response served with authorization, count %d", count)
+	}
+	serveTest(hnd, "GET", "/page", nil)
+	if count != 4 {
+		t.Fatalf("anonymous response not cached, count %d", count)
+	}
+}
+
+func TestCachePublicCredentials(t *testing.T) {
+	for _, cc := range []string{"public, max-age=60", "s-maxage=60"} {
+		var count int32
+		_, hnd := newCacheTestHandler(&count, nil, func(req SvrReq) QSession {
+			return &headerTestSession{textTestSession{"shared"},
+				http.Header{"Cache-Control": []string{cc}}}
+		})
+		cookie := http.Header{"Cookie": []string{"sid=1"}}
+		serveTest(hnd, "GET", "/page", cookie)
+		serveTest(hnd, "GET", "/page", nil)
+		serveTest(hnd, "GET", "/page", cookie)
+		if count != 1 {
+			t.Fatalf("%q: public response not shared, count %d", cc, count)
+		}
+	}
+}
+
+func TestCacheHostKey(t *testing.T) {
+	var count int32
+	_, hnd := newCacheTestHandler(&count, nil, func(req SvrReq) QSession {
+		return CreateRedirectSession("/login", RdirMovePermanently)
+	})
+	req := httptest.NewRequest("GET", "/old", nil)
+	req.Host = "evil.example"
+	hnd(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("GET", "/old", nil)
+	req.Host = "good.example"
+	rec := httptest.NewRecorder()
+	hnd(rec, req)
+	if loc := rec.Header().Get("Location"); loc != "http://good.example/login" {
+		t.Fatalf("Location %q, count %d", loc, count)
+	}
+	if count != 2 {
+		t.Fatalf("hosts share cache entry, count %d", count)
+	}
+	req = httptest.NewRequest("GET", "/old", nil)
+	req.Host = "good.example"
+	rec = httptest.NewRecorder()
+	hnd(rec, req)
+	if count != 2 || rec.Header().Get("Location") != "http://good.example/login" {
+		t.Fatalf("redirect not cached by host, count %d", count)
+	}
+}
+
+func TestCacheHitAndPurge(t *testing.T) {
+	var count int32
+	inst, hnd := newCacheTestHandler(&count, nil, func(req SvrReq) QSession {
+		return &textTestSession{"v" + strconv.Itoa(int(count))}
+	})
+	serveTest(hnd, "GET", "/doc/a", nil)
+	serveTest(hnd, "GET", "/doc/b?x=1", nil)
+	rec := serveTest(hnd, "GET", "/doc/a", nil)
+	if count != 2 || rec.Body.String() != "v1" ||
+		rec.Header().Get("Age") == "" {
+		t.Fatalf("count %d, body %q, Age %q", count, rec.Body.String(),
+			rec.Header().Get("Age"))
+	}
+	if serveTest(hnd, "POST", "/doc/a", nil); count != 3 {
+		t.Fatalf("POST served from cache, count %d", count)
+	}
+	if n := inst.PurgeCache("/doc/b"); n != 1 {
+		t.Fatalf("purged %d", n)
+	}
+	serveTest(hnd, "GET", "/doc/a", nil)
+	rec = serveTest(hnd, "GET", "/doc/b?x=1", nil)
+	if count != 4 || rec.Body.String() != "v4" {
+		t.Fatalf("count %d, body %q", count, rec.Body.String())
+	}
+}
+
+func TestCacheStaleRefresh(t *testing.T) {
+	var count int32
+	_, hnd := newCacheTestHandler(&count,
+		&CacheConf{TTL: 20 * time.Millisecond, StaleRefresh: time.Hour},
+		func(req SvrReq) QSession {
+			return &textTestSession{
+				"v" + strconv.Itoa(int(atomic.LoadInt32(&count)))}
+		})
+	serveTest(hnd, "GET", "/doc", nil)
+	time.Sleep(30 * time.Millisecond)
+	// stale response is served and refreshed in background
+	if rec := serveTest(hnd, "GET", "/doc", nil); rec.Body.String() != "v1" {
+		t.Fatalf("stale body %q", rec.Body.String())
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		rec := serveTest(hnd, "GET", "/doc", nil)
+		if rec.Body.String() == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not refreshed, body %q", rec.Body.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&count); n != 2 {
+		t.Fatalf("count %d", n)
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	for _, hdr := range []http.Header{
+		{"Cache-Control": {"no-store"}},
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Set-Cookie": {"sid=1"}},
+	} {
+		var count int32
+		_, hnd := newCacheTestHandler(&count, nil, func(req SvrReq) QSession {
+			return &headerTestSession{textTestSession{"x"}, hdr}
+		})
+		serveTest(hnd, "GET", "/", nil)
+		serveTest(hnd, "GET", "/", nil)
+		if count != 2 {
+			t.Fatalf("%v: response cached", hdr)
+		}
+	}
+}
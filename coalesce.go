@@ -0,0 +1,206 @@
+/* General Web framework
+ * coalescing of identical concurrent requests
+ * Qujie Tech 2019-08-08
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default options of coalescing handle
+const (
+	coalesceDefaultWaiters = 100
+	coalesceDefaultWait    = 10 * time.Second
+)
+
+// CoalesceConf defined options of request coalescing handle
+type CoalesceConf struct {
+	KeyFunc    func(req SvrReq) string // request key, empty for not coalesce
+	MaxWaiters int                     // max waiters for a request
+	MaxWait    time.Duration           // max wait time for a waiter
+}
+
+// a request in processing
+type coalesceFlight struct {
+	done    chan bool  // closed when response finished
+	rsp     *recordRsp // response, nil if failed or not shareable
+	waiters int
+}
+
+// request coalescing handle decorator, it implement QHandle
+type coalesceHandle struct {
+	hnd     QHandle
+	conf    CoalesceConf
+	lock    sync.Mutex
+	flights map[string]*coalesceFlight
+}
+
+// session of request which process the request for all waiters
+type coalesceLead struct {
+	sesDecorator
+	hnd    *coalesceHandle
+	key    string
+	flight *coalesceFlight
+}
+
+// session of request which wait response of leader
+type coalesceWait struct {
+	sesDecorator
+	flight *coalesceFlight
+	wait   time.Duration
+	begin  func() QSession // create own session if leader failed
+	replay *replaySession
+}
+
+// CreateCoalesceHandle create a handle which collapse identical concurrent
+// requests into one session of hnd and share it response to all waiters.
+// conf can be nil for default options, which coalesce GET and HEAD requests
+// without credentials by method, path and query. response with `Set-Cookie`
+// or private `Cache-Control` is never shared, waiters process it by self
+func CreateCoalesceHandle(hnd QHandle, conf *CoalesceConf) QHandle {
+	chnd := &coalesceHandle{hnd: hnd, flights: make(map[string]*coalesceFlight)}
+	if conf != nil {
+		chnd.conf = *conf
+	}
+	if chnd.conf.KeyFunc == nil {
+		chnd.conf.KeyFunc = defaultCoalesceKey
+	}
+	if chnd.conf.MaxWaiters <= 0 {
+		chnd.conf.MaxWaiters = coalesceDefaultWaiters
+	}
+	if chnd.conf.MaxWait <= 0 {
+		chnd.conf.MaxWait = coalesceDefaultWait
+	}
+	return chnd
+}
+
+// default key of coalescing, request with credentials is not coalesced
+func defaultCoalesceKey(req SvrReq) string {
+	if req.Method() != MethodGET && req.Method() != MethodHEAD {
+		return ""
+	}
+	if hasCredentials(req) {
+		return ""
+	}
+	return req.Method() + " " + req.FullPath() + "?" + req.RawQuery()
+}
+
+// check response can be shared to other clients
+func coalesceShareable(rsp *recordRsp) bool {
+	if len(rsp.header["Set-Cookie"]) > 0 {
+		return false
+	}
+	for _, directive := range strings.Split(
+		rsp.header.Get("Cache-Control"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		switch strings.ToLower(kv[0]) {
+		case "private", "no-store":
+			return false
+		}
+	}
+	return true
+}
+
+//////////////////// coalesceHandle methods ////////////////////
+
+// coalesceHandle: init inner handle
+func (hnd *coalesceHandle) InitHandler(
+	inst QInstance, rte RouteHandle, ptree *RouteTree) {
+	hnd.hnd.InitHandler(inst, rte, ptree)
+}
+
+// coalesceHandle: finish a flight and wakeup waiters
+func (hnd *coalesceHandle) finish(key string, flight *coalesceFlight) {
+	hnd.lock.Lock()
+	defer hnd.lock.Unlock()
+	if hnd.flights[key] == flight {
+		delete(hnd.flights, key)
+	}
+	close(flight.done)
+}
+
+// coalesceHandle: join a flight or lead a new flight
+func (hnd *coalesceHandle) BeginSession(
+	req SvrReq, env interface{}) QSession {
+	key := hnd.conf.KeyFunc(req)
+	if key == "" {
+		return hnd.hnd.BeginSession(req, env)
+	}
+	hnd.lock.Lock()
+	if flight, ok := hnd.flights[key]; ok {
+		if flight.waiters >= hnd.conf.MaxWaiters {
+			hnd.lock.Unlock()
+			return hnd.hnd.BeginSession(req, env)
+		}
+		flight.waiters++
+		hnd.lock.Unlock()
+		return &coalesceWait{
+			flight: flight,
+			wait:   hnd.conf.MaxWait,
+			begin:  func() QSession { return hnd.hnd.BeginSession(req, env) },
+		}
+	}
+	flight := &coalesceFlight{done: make(chan bool)}
+	hnd.flights[key] = flight
+	hnd.lock.Unlock()
+	ses := beginCapture(hnd.hnd, req, env, func(rsp *recordRsp) {
+		if coalesceShareable(rsp) {
+			flight.rsp = rsp
+		}
+	})
+	if ses == nil {
+		hnd.finish(key, flight)
+		return nil
+	}
+	return &coalesceLead{sesDecorator{ses}, hnd, key, flight}
+}
+
+//////////////////// coalesceLead methods ////////////////////
+
+// coalesceLead: process request and share response
+func (ses *coalesceLead) EnterServer() (redirect string, err error) {
+	defer ses.hnd.finish(ses.key, ses.flight)
+	return ses.QSession.EnterServer()
+}
+
+//////////////////// coalesceWait methods ////////////////////
+
+// coalesceWait: wait response of leader or process request by self
+func (ses *coalesceWait) EnterServer() (redirect string, err error) {
+	select {
+	case <-ses.flight.done:
+		if ses.flight.rsp != nil {
+			ses.replay = &replaySession{ses.flight.rsp, nil}
+			return "", nil
+		}
+	case <-time.After(ses.wait):
+	}
+	if ses.QSession = ses.begin(); ses.QSession == nil {
+		return "", errors.New("except session")
+	}
+	return ses.QSession.EnterServer()
+}
+
+// coalesceWait: shared or own response header
+func (ses *coalesceWait) BeginResponse(header http.Header) (status int) {
+	if ses.replay != nil {
+		return ses.replay.BeginResponse(header)
+	}
+	return ses.QSession.BeginResponse(header)
+}
+
+// coalesceWait: shared or own response body
+func (ses *coalesceWait) WriteResponse(rsp io.Writer) []byte {
+	if ses.replay != nil {
+		return ses.replay.WriteResponse(rsp)
+	}
+	return ses.QSession.WriteResponse(rsp)
+}
@@ -0,0 +1,162 @@
+/* General Web framework
+ * tests of request coalescing
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// key of coalescing test requests
+const coalesceTestKey = "GET /doc?"
+
+// session which wait a signal and may fail
+type blockTestSession struct {
+	headerTestSession
+	release chan bool
+	fail    bool
+}
+
+// blockTestSession: wait and fail if required
+func (ses *blockTestSession) EnterServer() (string, error) {
+	if ses.release != nil {
+		<-ses.release
+	}
+	if ses.fail {
+		return "", errors.New("leader failed")
+	}
+	return "", nil
+}
+
+// serve concurrent requests through coalescing handle. first session is
+// created by first, it is released after other requests join the flight
+func serveCoalesceTest(reqs []http.Header,
+	first func(release chan bool) QSession,
+	other func() QSession) (int32, []*httptest.ResponseRecorder) {
+	var count int32
+	release := make(chan bool)
+	chnd := CreateCoalesceHandle(CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			if atomic.AddInt32(&count, 1) == 1 {
+				return first(release)
+			}
+			return other()
+		}), nil).(*coalesceHandle)
+	_, hnd := newTestHandler(chnd)
+	recs := make([]*httptest.ResponseRecorder, len(reqs))
+	wg := sync.WaitGroup{}
+	for i, hdr := range reqs {
+		wg.Add(1)
+		go (func(i int, hdr http.Header) {
+			defer wg.Done()
+			recs[i] = serveTest(hnd, "GET", "/doc", hdr)
+		})(i, hdr)
+		if i == 0 {
+			for atomic.LoadInt32(&count) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	// wait waiters join the flight
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		chnd.lock.Lock()
+		flight := chnd.flights[coalesceTestKey]
+		waiters := 0
+		if flight != nil {
+			waiters = flight.waiters
+		}
+		chnd.lock.Unlock()
+		if waiters >= len(reqs)-1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	return atomic.LoadInt32(&count), recs
+}
+
+func TestCoalesceShared(t *testing.T) {
+	count, recs := serveCoalesceTest(make([]http.Header, 4),
+		func(release chan bool) QSession {
+			return &blockTestSession{
+				headerTestSession{textTestSession{"shared"}, nil}, release, false}
+		}, func() QSession {
+			return &textTestSession{"own"}
+		})
+	if count != 1 {
+		t.Fatalf("count %d", count)
+	}
+	for _, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != "shared" {
+			t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCoalesceLeaderFailed(t *testing.T) {
+	count, recs := serveCoalesceTest(make([]http.Header, 3),
+		func(release chan bool) QSession {
+			return &blockTestSession{
+				headerTestSession{textTestSession{"x"}, nil}, release, true}
+		}, func() QSession {
+			return &textTestSession{"own"}
+		})
+	if count != 3 {
+		t.Fatalf("count %d", count)
+	}
+	if recs[0].Code != http.StatusInternalServerError {
+		t.Fatalf("leader status %d", recs[0].Code)
+	}
+	for _, rec := range recs[1:] {
+		if rec.Code != http.StatusOK || rec.Body.String() != "own" {
+			t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCoalescePrivate(t *testing.T) {
+	for _, hdr := range []http.Header{
+		{"Set-Cookie": {"sid=1"}},
+		{"Cache-Control": {"private"}},
+		{"Cache-Control": {"no-store"}},
+	} {
+		count, recs := serveCoalesceTest(make([]http.Header, 3),
+			func(release chan bool) QSession {
+				return &blockTestSession{
+					headerTestSession{textTestSession{"private"}, hdr},
+					release, false}
+			}, func() QSession {
+				return &textTestSession{"own"}
+			})
+		if count != 3 || recs[1].Body.String() != "own" {
+			t.Fatalf("%v: shared, count %d", hdr, count)
+		}
+	}
+}
+
+func TestCoalesceCredentials(t *testing.T) {
+	for _, name := range []string{"Cookie", "Authorization"} {
+		req := httptest.NewRequest("GET", "/doc", nil)
+		req.Header.Set(name, "x")
+		srq := createReqObj(newTestInstance(), httptest.NewRecorder(), req)
+		if key := defaultCoalesceKey(srq); key != "" {
+			t.Fatalf("%s: key %q", name, key)
+		}
+	}
+	req := httptest.NewRequest("GET", "/doc", nil)
+	srq := createReqObj(newTestInstance(), httptest.NewRecorder(), req)
+	if key := defaultCoalesceKey(srq); key != coalesceTestKey {
+		t.Fatalf("key %q", key)
+	}
+}
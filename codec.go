@@ -0,0 +1,326 @@
+/* General Web framework
+ * body codec registry for request decoding and response encoding
+ * Qujie Tech 2019-08-26
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Codec is decoder and encoder of a media type
+type Codec interface {
+	Decode(rd io.Reader, ref interface{}) error
+	Encode(wr io.Writer, val interface{}) error
+}
+
+// JSON codec
+type jsonCodec struct{}
+
+// XML codec
+type xmlCodec struct{}
+
+// root element of XML list
+const xmlListRoot = "items"
+
+// newline delimited JSON codec. it decode to a pointer of slice and encode a
+// slice as lines
+type ndjsonCodec struct{}
+
+// codec registry, media types are kept in order of registration for response
+// negotiation
+var codecRegistry = struct {
+	lock   sync.RWMutex
+	codecs map[string]Codec
+	order  []string
+}{
+	codecs: map[string]Codec{
+		"application/json":     jsonCodec{},
+		"application/xml":      xmlCodec{},
+		"text/xml":             xmlCodec{},
+		"application/x-ndjson": ndjsonCodec{},
+	},
+	order: []string{
+		"application/json", "application/xml", "text/xml",
+		"application/x-ndjson",
+	},
+}
+
+// session which encode a value by codec negotiated with `Accept`
+type encodeSession struct {
+	req    SvrReq
+	status int
+	val    interface{}
+	media  string
+	data   []byte
+}
+
+// RegisterCodec register codec for a media type, for example
+// `application/cbor`. codec of same media type is replaced, nil codec remove
+// the media type
+func RegisterCodec(media string, codec Codec) {
+	media = strings.ToLower(strings.TrimSpace(media))
+	if media == "" {
+		panic("invalid codec media type")
+	}
+	codecRegistry.lock.Lock()
+	defer codecRegistry.lock.Unlock()
+	_, exists := codecRegistry.codecs[media]
+	if codec == nil {
+		if exists {
+			delete(codecRegistry.codecs, media)
+			for i, m := range codecRegistry.order {
+				if m == media {
+					codecRegistry.order = append(
+						codecRegistry.order[:i:i], codecRegistry.order[i+1:]...)
+					break
+				}
+			}
+		}
+		return
+	}
+	codecRegistry.codecs[media] = codec
+	if !exists {
+		codecRegistry.order = append(codecRegistry.order, media)
+	}
+}
+
+// GetCodec get codec of media type. media type with `+json` or `+xml` suffix
+// use JSON or XML codec if it is not registered. nil if not found
+func GetCodec(media string) Codec {
+	media = strings.ToLower(strings.TrimSpace(media))
+	codecRegistry.lock.RLock()
+	defer codecRegistry.lock.RUnlock()
+	if codec, ok := codecRegistry.codecs[media]; ok {
+		return codec
+	}
+	switch {
+	case strings.HasSuffix(media, "+json"):
+		return codecRegistry.codecs["application/json"]
+	case strings.HasSuffix(media, "+xml"):
+		return codecRegistry.codecs["application/xml"]
+	}
+	return nil
+}
+
+// media types of registered codecs
+func codecMediaTypes() []string {
+	codecRegistry.lock.RLock()
+	defer codecRegistry.lock.RUnlock()
+	ret := make([]string, len(codecRegistry.order))
+	copy(ret, codecRegistry.order)
+	return ret
+}
+
+// CreateEncodeSession create a session which response val encoded by codec
+// negotiated with `Accept` header. first registered codec (JSON) is used if
+// `Accept` is absent, and 406 is responded if no codec acceptable
+func CreateEncodeSession(req SvrReq, status int, val interface{}) QSession {
+	return &encodeSession{req, status, val, "", nil}
+}
+
+// check value is a list for XML codec, byte slice is character data
+func xmlIsList(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		return rv.Type().Elem().Kind() != reflect.Uint8
+	}
+	return false
+}
+
+//////////////////// codecs methods ////////////////////
+
+// jsonCodec: decode
+func (jsonCodec) Decode(rd io.Reader, ref interface{}) error {
+	return json.NewDecoder(rd).Decode(ref)
+}
+
+// jsonCodec: encode
+func (jsonCodec) Encode(wr io.Writer, val interface{}) error {
+	return json.NewEncoder(wr).Encode(val)
+}
+
+// xmlCodec: decode. pointer of slice is decoded from children of root
+// element, other value from root element
+func (xmlCodec) Decode(rd io.Reader, ref interface{}) error {
+	dec := xml.NewDecoder(rd)
+	rv := reflect.ValueOf(ref)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || !xmlIsList(rv.Elem()) {
+		return dec.Decode(ref)
+	}
+	sl := rv.Elem()
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				depth++
+				continue
+			}
+			elem := reflect.New(sl.Type().Elem())
+			if err := dec.DecodeElement(elem.Interface(), &t); err != nil {
+				return err
+			}
+			sl = reflect.Append(sl, elem.Elem())
+		case xml.EndElement:
+			rv.Elem().Set(sl)
+			return nil
+		}
+	}
+}
+
+// xmlCodec: encode. slice and array are wrapped in root element `items`
+// because XML document has only one root element
+func (xmlCodec) Encode(wr io.Writer, val interface{}) error {
+	if _, err := io.WriteString(wr, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(wr)
+	rv := reflect.ValueOf(val)
+	if !xmlIsList(rv) {
+		return enc.Encode(val)
+	}
+	root := xml.StartElement{Name: xml.Name{Local: xmlListRoot}}
+	if err := enc.EncodeToken(root); err != nil {
+		return err
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if err := enc.Encode(rv.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// ndjsonCodec: decode lines and append to slice which ref point to
+func (ndjsonCodec) Decode(rd io.Reader, ref interface{}) error {
+	rv := reflect.ValueOf(ref)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() ||
+		rv.Elem().Kind() != reflect.Slice {
+		return errors.New("NDJSON must be decoded to a pointer of slice")
+	}
+	sl := rv.Elem()
+	scan := bufio.NewScanner(rd)
+	scan.Buffer(make([]byte, 0, 4096), int(ContentReadHardLimit))
+	for line := 1; scan.Scan(); line++ {
+		data := bytes.TrimSpace(scan.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		elem := reflect.New(sl.Type().Elem())
+		if err := json.Unmarshal(data, elem.Interface()); err != nil {
+			return fmt.Errorf("NDJSON line %d: %s", line, err)
+		}
+		sl = reflect.Append(sl, elem.Elem())
+	}
+	if err := scan.Err(); err != nil {
+		return err
+	}
+	rv.Elem().Set(sl)
+	return nil
+}
+
+// ndjsonCodec: encode elements of slice as lines, other value as a line
+func (ndjsonCodec) Encode(wr io.Writer, val interface{}) error {
+	enc := json.NewEncoder(wr)
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return enc.Encode(val)
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if err := enc.Encode(rv.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//////////////////// svrRspObj codec reader ////////////////////
+
+// read body by codec of `Content-Type`. body is limited by `LimitPost`, and
+// unsupported media type is responded as 415 by framework
+func (srq *svrRspObj) ReadBody(ref interface{}) error {
+	media, _, err := mime.ParseMediaType(srq.Header().Get("Content-Type"))
+	if err != nil {
+		return &HTTPError{http.StatusUnsupportedMediaType,
+			"invalid content type"}
+	}
+	codec := GetCodec(media)
+	if codec == nil {
+		return &HTTPError{http.StatusUnsupportedMediaType,
+			"unsupported content type " + media}
+	}
+	if _, err := srq.autoBuffer(); err != nil {
+		return err
+	}
+	if srq.mrkReaded && srq.rawContent != nil {
+		return codec.Decode(bytes.NewReader(srq.rawContent), ref)
+	}
+	if err := srq.checkBodyReader(CntReaderCodec); err != nil {
+		return err
+	}
+	srq.mrkReader = CntReaderCodec
+	srq.mrkReaded = true
+	return codec.Decode(&bodyLimitReader{
+		srq.req.Body, int64(srq.inst.InstConf().LimitPost)}, ref)
+}
+
+//////////////////// encodeSession methods ////////////////////
+
+// encodeSession: negotiate codec and encode value
+func (ses *encodeSession) EnterServer() (redirect string, err error) {
+	offers := codecMediaTypes()
+	if len(offers) == 0 {
+		return "", errors.New("no codec registered")
+	}
+	ses.media = negotiateType(ses.req.Header().Get("Accept"), offers)
+	if ses.media == "" {
+		return "", &HTTPError{http.StatusNotAcceptable,
+			"no acceptable content type"}
+	}
+	buf := &bytes.Buffer{}
+	if err := GetCodec(ses.media).Encode(buf, ses.val); err != nil {
+		return "", err
+	}
+	ses.data = buf.Bytes()
+	return "", nil
+}
+
+// encodeSession: response header
+func (ses *encodeSession) BeginResponse(header http.Header) (status int) {
+	header.Add("Vary", "Accept")
+	if strings.HasPrefix(ses.media, "text/") {
+		header.Set("Content-Type", ses.media+";charset=utf-8")
+	} else {
+		header.Set("Content-Type", ses.media)
+	}
+	return ses.status
+}
+
+// encodeSession: encoded value
+func (ses *encodeSession) WriteResponse(rsp io.Writer) []byte {
+	return ses.data
+}
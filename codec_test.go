@@ -0,0 +1,169 @@
+/* General Web framework
+ * tests of body codec registry
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// item of codec tests
+type codecTestItem struct {
+	ID   int    `xml:"id" json:"id"`
+	Name string `xml:"name" json:"name"`
+}
+
+// codec which write value as text
+type textTestCodec struct{}
+
+// textTestCodec: decode
+func (textTestCodec) Decode(rd io.Reader, ref interface{}) error {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	sp, ok := ref.(*string)
+	if !ok {
+		return errors.New("text must be decoded to string")
+	}
+	*sp = string(data)
+	return nil
+}
+
+// textTestCodec: encode
+func (textTestCodec) Encode(wr io.Writer, val interface{}) error {
+	_, err := io.WriteString(wr, val.(string))
+	return err
+}
+
+func TestXMLCodecList(t *testing.T) {
+	codec := GetCodec("application/xml")
+	items := []codecTestItem{{1, "a"}, {2, "b"}}
+	buf := &bytes.Buffer{}
+	if err := codec.Encode(buf, items); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "<items><codecTestItem>") {
+		t.Fatalf("encoded %q", buf.String())
+	}
+	var got []codecTestItem
+	if err := codec.Decode(bytes.NewReader(buf.Bytes()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, items) {
+		t.Fatalf("decoded %v", got)
+	}
+	var empty []codecTestItem
+	if err := codec.Decode(strings.NewReader("<items/>"), &empty); err != nil ||
+		len(empty) != 0 {
+		t.Fatalf("empty list %v, %v", empty, err)
+	}
+	if err := codec.Decode(strings.NewReader("<items><codecTestItem>"),
+		&empty); err == nil {
+		t.Fatal("truncated list accepted")
+	}
+	buf.Reset()
+	var one codecTestItem
+	if err := codec.Encode(buf, items[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := codec.Decode(buf, &one); err != nil || one != items[0] {
+		t.Fatalf("decoded %v, %v", one, err)
+	}
+}
+
+func TestNDJSONCodec(t *testing.T) {
+	codec := GetCodec("application/x-ndjson")
+	var got []codecTestItem
+	err := codec.Decode(strings.NewReader(
+		"{\"id\":1,\"name\":\"a\"}\n\n{\"id\":2,\"name\":\"b\"}\n"), &got)
+	if err != nil || len(got) != 2 || got[1].Name != "b" {
+		t.Fatalf("decoded %v, %v", got, err)
+	}
+	if err := codec.Decode(strings.NewReader("{}\n{bad\n"), &got); err == nil ||
+		!strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("bad line: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := codec.Encode(buf, got[:2]); err != nil ||
+		strings.Count(buf.String(), "\n") != 2 {
+		t.Fatalf("encoded %q, %v", buf.String(), err)
+	}
+}
+
+func TestCodecRegistry(t *testing.T) {
+	if GetCodec("application/problem+json") != GetCodec("application/json") ||
+		GetCodec("application/atom+xml") != GetCodec("application/xml") {
+		t.Fatal("suffix codec not found")
+	}
+	if GetCodec("application/x-test") != nil {
+		t.Fatal("unknown codec found")
+	}
+	RegisterCodec(" Application/X-Test ", textTestCodec{})
+	defer RegisterCodec("application/x-test", nil)
+	if GetCodec("application/x-test") == nil {
+		t.Fatal("registered codec not found")
+	}
+	_, hnd := newTestHandler(CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			return CreateEncodeSession(req, http.StatusOK, "hello")
+		}))
+	rec := serveTest(hnd, "GET", "/",
+		http.Header{"Accept": {"application/x-test"}})
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" ||
+		rec.Header().Get("Content-Type") != "application/x-test" {
+		t.Fatalf("status %d, %v, body %q", rec.Code, rec.Header(), rec.Body)
+	}
+	rec = serveTest(hnd, "GET", "/", http.Header{"Accept": {"image/png"}})
+	if rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("status %d", rec.Code)
+	}
+	RegisterCodec("application/x-test", nil)
+	if GetCodec("application/x-test") != nil {
+		t.Fatal("removed codec found")
+	}
+	for _, media := range codecMediaTypes() {
+		if media == "application/x-test" {
+			t.Fatal("removed codec in order")
+		}
+	}
+}
+
+func TestReadBodyCodec(t *testing.T) {
+	for _, c := range []struct {
+		ctype  string
+		status int
+	}{
+		{"application/xml", 0},
+		{"application/x-unknown", http.StatusUnsupportedMediaType},
+		{"bad type;", http.StatusUnsupportedMediaType},
+	} {
+		req := httptest.NewRequest("POST", "/",
+			strings.NewReader("<items><codecTestItem><id>1</id>"+
+				"</codecTestItem></items>"))
+		req.Header.Set("Content-Type", c.ctype)
+		srq := createReqObj(newTestInstance(), httptest.NewRecorder(), req)
+		var got []codecTestItem
+		err := srq.ReadBody(&got)
+		if c.status == 0 {
+			if err != nil || len(got) != 1 || got[0].ID != 1 {
+				t.Fatalf("%s: %v, %v", c.ctype, got, err)
+			}
+			continue
+		}
+		if herr, ok := err.(*HTTPError); !ok || herr.StatusCode() != c.status {
+			t.Fatalf("%s: %v", c.ctype, err)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+/* General Web framework
+ * transparent response compression
+ * Qujie Tech 2019-07-25
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// content types which are already compressed or streamed
+var defaultSkipTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-bzip2", "application/x-7z-compressed",
+	"application/x-rar-compressed", "application/x-xz",
+	"application/octet-stream", "text/event-stream",
+}
+
+// compression handle decorator, it implement QHandle
+type compressHandle struct {
+	inst QInstance
+	hnd  QHandle
+}
+
+// compressed ResponseWriter. it work for raw handle and session output
+type compressWriter struct {
+	rsp         http.ResponseWriter // underlying writer
+	conf        CompressConf
+	encoding    string           // negotiated encoding, empty for identity
+	enc         *compressEncoder // active encoder of raw handle output
+	compress    bool             // mark response is compressed
+	decided     bool             // mark compression decided
+	wroteHeader bool             // mark header is written
+	status      int              // status of raw handle output
+	pending     []byte           // raw handle output before decided
+}
+
+// encoder which write compressed stream to a writer
+type compressEncoder struct {
+	io.WriteCloser
+	wr io.Writer
+}
+
+// inner session output read ahead to decide by size, inner WriteResponse run
+// in another goroutine and each write is passed through chunks
+type compressPipe struct {
+	chunks  chan []byte   // written data, nil for flush, closed at end
+	done    chan struct{} // closed when output is not needed anymore
+	stopped bool          // mark done is closed
+	flushed bool          // mark read ahead is stopped by flush
+	ret     []byte        // return of inner WriteResponse
+	perr    interface{}   // panic of inner WriteResponse
+}
+
+// compression session decorator
+type compressSession struct {
+	sesDecorator
+	cw   *compressWriter
+	body []byte        // output read ahead, at most `MinSize` unless ended
+	pipe *compressPipe // read ahead output, nil if not needed
+}
+
+// CreateCompressHandle create a handle which compress response of all
+// sessions from hnd. hnd can be a RouteHandle for a subtree
+func CreateCompressHandle(hnd QHandle) QHandle {
+	return &compressHandle{nil, hnd}
+}
+
+// CreateCompressSession wrap a session to compress it response
+func CreateCompressSession(
+	inst QInstance, req SvrReq, ses QSession) QSession {
+	cw := newCompressWriter(inst, req, req.rawRsp())
+	return &compressSession{sesDecorator{ses}, cw, nil, nil}
+}
+
+// check compression options
+func checkCompressConf(conf CompressConf) error {
+	if conf.Level < flate.HuffmanOnly || conf.Level > flate.BestCompression {
+		return fmt.Errorf("invalid compress level %d", conf.Level)
+	}
+	return nil
+}
+
+// negotiate compression by `Accept-Encoding`
+func negotiateEncoding(accept string) string {
+	best, bestq := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		q, spec := 0.0, -1
+		for _, acc := range parseQList(accept) {
+			s := -1
+			if acc.value == coding || (coding == "gzip" && acc.value == "x-gzip") {
+				s = 1
+			} else if acc.value == "*" {
+				s = 0
+			}
+			if s > spec {
+				q, spec = acc.q, s
+			}
+		}
+		if q > bestq {
+			best, bestq = coding, q
+		}
+	}
+	return best
+}
+
+// create compressed writer for request
+func newCompressWriter(
+	inst QInstance, req SvrReq, rsp http.ResponseWriter) *compressWriter {
+	cw := &compressWriter{rsp: rsp, conf: inst.InstConf().Compress}
+	if req.Method() != MethodHEAD {
+		cw.encoding = negotiateEncoding(req.Header().Get("Accept-Encoding"))
+	}
+	return cw
+}
+
+// match content type with type list, item end with '/' match a prefix
+func matchTypeList(ctype string, types []string) bool {
+	for _, t := range types {
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(ctype, t) {
+			return true
+		}
+		if ctype == t || strings.HasPrefix(ctype, t+"+") {
+			return true
+		}
+	}
+	return false
+}
+
+//////////////////// compressHandle methods ////////////////////
+
+// compressHandle: init inner handle
+func (hnd *compressHandle) InitHandler(
+	inst QInstance, rte RouteHandle, ptree *RouteTree) {
+	hnd.inst = inst
+	hnd.hnd.InitHandler(inst, rte, ptree)
+}
+
+// compressHandle: create compressed session
+func (hnd *compressHandle) BeginSession(
+	req SvrReq, env interface{}) QSession {
+	cw := newCompressWriter(hnd.inst, req, req.rawRsp())
+	ses := hnd.hnd.BeginSession(&rspOverrideReq{req, cw}, env)
+	if ses == nil {
+		return nil
+	}
+	return &compressSession{sesDecorator{ses}, cw, nil, nil}
+}
+
+//////////////////// compressWriter methods ////////////////////
+
+// compressWriter: check response can be compressed by status and type
+func (cw *compressWriter) eligible(header http.Header, status int) bool {
+	if status < 200 || status == http.StatusNoContent ||
+		status == http.StatusNotModified ||
+		header.Get("Content-Encoding") != "" {
+		return false
+	}
+	ctype := strings.ToLower(strings.TrimSpace(
+		strings.Split(header.Get("Content-Type"), ";")[0]))
+	if ctype == "" || matchTypeList(ctype, defaultSkipTypes) ||
+		matchTypeList(ctype, cw.conf.SkipTypes) {
+		return false
+	}
+	return len(cw.conf.Types) == 0 || matchTypeList(ctype, cw.conf.Types)
+}
+
+// compressWriter: check body size must be known before decide. it is not
+// needed if `Content-Length` is set or response is never compressed
+func (cw *compressWriter) needSize(header http.Header, status int) bool {
+	return cw.encoding != "" && cw.conf.MinSize > 0 &&
+		header.Get("Content-Length") == "" && cw.eligible(header, status)
+}
+
+// compressWriter: decide compression by response header and body size, size
+// is -1 if unknown. header is updated for compressed response, and ETag is
+// marked weak
+func (cw *compressWriter) decide(header http.Header, status int, size int64) {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+	if !cw.eligible(header, status) {
+		return
+	}
+	if clen := header.Get("Content-Length"); clen != "" {
+		if n, err := strconv.ParseInt(clen, 10, 64); err == nil {
+			size = n
+		}
+	}
+	if size >= 0 && size < cw.conf.MinSize {
+		return
+	}
+	header.Add("Vary", "Accept-Encoding")
+	if cw.encoding == "" {
+		return
+	}
+	cw.compress = true
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	// compressed representation must not share strong ETag with identity
+	etag := header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// compressWriter: create encoder of negotiated encoding on wr
+func (cw *compressWriter) newEncoder(wr io.Writer) *compressEncoder {
+	level := cw.conf.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var enc io.WriteCloser
+	if cw.encoding == "gzip" {
+		enc, _ = gzip.NewWriterLevel(wr, level)
+	} else {
+		enc, _ = flate.NewWriter(wr, level)
+	}
+	return &compressEncoder{enc, wr}
+}
+
+// compressWriter: decide and commit header of raw handle output, pending
+// output is written after header
+func (cw *compressWriter) commit(size int64) {
+	cw.decide(cw.rsp.Header(), cw.status, size)
+	if cw.compress {
+		cw.enc = cw.newEncoder(cw.rsp)
+	}
+	cw.rsp.WriteHeader(cw.status)
+	if pending := cw.pending; len(pending) > 0 {
+		cw.pending = nil
+		cw.Write(pending)
+	}
+}
+
+// compressWriter: finish compressed stream
+func (cw *compressWriter) close() error {
+	if cw.wroteHeader && !cw.decided {
+		cw.commit(int64(len(cw.pending)))
+	}
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	cw.enc = nil
+	return err
+}
+
+// compressWriter: ResponseWriter.Header
+func (cw *compressWriter) Header() http.Header {
+	return cw.rsp.Header()
+}
+
+// compressWriter: ResponseWriter.WriteHeader. header is deferred until
+// output reach `MinSize` if size is unknown
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = statusCode
+	if !cw.needSize(cw.rsp.Header(), statusCode) {
+		cw.commit(-1)
+	}
+}
+
+// compressWriter: ResponseWriter.Write
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.pending = append(cw.pending, data...)
+		if int64(len(cw.pending)) >= cw.conf.MinSize {
+			cw.commit(int64(len(cw.pending)))
+		}
+		return len(data), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(data)
+	}
+	return cw.rsp.Write(data)
+}
+
+// compressWriter: features of underlying writer
+func (cw *compressWriter) rspFeatures() (flush, hijack, push bool) {
+	return rspFeatures(cw.rsp)
+}
+
+// compressWriter: http.Flusher. flush encoder and underlying writer
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.commit(-1) // streamed output is compressed
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	} else if fl, ok := cw.rsp.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// compressWriter: http.Hijacker. connection is not compressed
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := cw.rsp.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	cw.decided = true
+	cw.wroteHeader = true
+	return hj.Hijack()
+}
+
+// compressWriter: http.Pusher
+func (cw *compressWriter) Push(target string, opts *http.PushOptions) error {
+	ps, ok := cw.rsp.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return ps.Push(target, opts)
+}
+
+//////////////////// compressEncoder methods ////////////////////
+
+// compressEncoder: http.Flusher. flush encoder and underlying writer
+func (enc *compressEncoder) Flush() {
+	if fl, ok := enc.WriteCloser.(interface{ Flush() error }); ok {
+		fl.Flush()
+	}
+	if fl, ok := enc.wr.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+//////////////////// compressPipe methods ////////////////////
+
+// error of inner write after output is not needed
+var errCompressStopped = errors.New("compressed output is stopped")
+
+// start inner WriteResponse in another goroutine
+func startCompressPipe(ses QSession) *compressPipe {
+	pipe := &compressPipe{chunks: make(chan []byte), done: make(chan struct{})}
+	go (func() {
+		defer (func() {
+			pipe.perr = recover()
+			close(pipe.chunks)
+		})()
+		pipe.ret = ses.WriteResponse(pipe)
+	})()
+	return pipe
+}
+
+// compressPipe: pass a chunk to reader
+func (pipe *compressPipe) send(chunk []byte) error {
+	select {
+	case pipe.chunks <- chunk:
+		return nil
+	case <-pipe.done:
+		return errCompressStopped
+	}
+}
+
+// compressPipe: io.Writer
+func (pipe *compressPipe) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if err := pipe.send(append([]byte{}, data...)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// compressPipe: http.Flusher
+func (pipe *compressPipe) Flush() {
+	pipe.send(nil)
+}
+
+// compressPipe: read ahead until limit, flush or end. end is true if inner
+// WriteResponse returned
+func (pipe *compressPipe) readAhead(limit int64) (body []byte, end bool) {
+	for int64(len(body)) < limit {
+		chunk, ok := <-pipe.chunks
+		if !ok {
+			body, pipe.ret = append(body, pipe.ret...), nil
+			return body, true
+		}
+		if chunk == nil {
+			pipe.flushed = true
+			return body, false
+		}
+		body = append(body, chunk...)
+	}
+	return body, false
+}
+
+// compressPipe: stop inner output and wait inner WriteResponse returned
+func (pipe *compressPipe) stop() {
+	if !pipe.stopped {
+		pipe.stopped = true
+		close(pipe.done)
+	}
+	for range pipe.chunks {
+	}
+}
+
+// compressPipe: write rest output and return of inner WriteResponse to wr,
+// flush is passed to wr
+func (pipe *compressPipe) copyTo(wr io.Writer) {
+	fl, _ := wr.(http.Flusher)
+	if pipe.flushed && fl != nil {
+		fl.Flush()
+	}
+	for chunk := range pipe.chunks {
+		if chunk == nil {
+			if fl != nil {
+				fl.Flush()
+			}
+			continue
+		}
+		if _, err := wr.Write(chunk); err != nil {
+			pipe.stop()
+			return
+		}
+	}
+	if pipe.perr != nil {
+		panic(pipe.perr)
+	}
+	if len(pipe.ret) > 0 {
+		wr.Write(pipe.ret)
+	}
+}
+
+//////////////////// compressSession methods ////////////////////
+
+// compressSession: enter inner session. raw handle may finish response here
+func (ses *compressSession) EnterServer() (redirect string, err error) {
+	redirect, err = ses.QSession.EnterServer()
+	if ses.cw.wroteHeader {
+		ses.cw.close()
+	}
+	return
+}
+
+// compressSession: decide compression after inner headers. if
+// `Content-Length` is absent, inner output is read ahead until `MinSize`,
+// flush or end of output to decide by size, and rest output is streamed
+func (ses *compressSession) BeginResponse(header http.Header) (status int) {
+	status = ses.QSession.BeginResponse(header)
+	size := int64(-1)
+	if ses.cw.needSize(header, status) {
+		ses.pipe = startCompressPipe(ses.QSession)
+		body, end := ses.pipe.readAhead(ses.cw.conf.MinSize)
+		if ses.body = body; end {
+			if ses.pipe.perr != nil {
+				panic(ses.pipe.perr)
+			}
+			size = int64(len(body))
+		}
+	}
+	ses.cw.decide(header, status, size)
+	ses.cw.wroteHeader = true
+	return status
+}
+
+// compressSession: write inner or read ahead response through encoder on rsp
+func (ses *compressSession) WriteResponse(rsp io.Writer) []byte {
+	var wr io.Writer = rsp
+	if ses.cw.compress {
+		enc := ses.cw.newEncoder(rsp)
+		defer enc.Close()
+		wr = enc
+	}
+	if ses.pipe != nil {
+		if len(ses.body) > 0 {
+			if _, err := wr.Write(ses.body); err != nil {
+				ses.pipe.stop()
+				return nil
+			}
+		}
+		ses.pipe.copyTo(wr)
+		ses.body = nil
+		return nil
+	}
+	ret := ses.QSession.WriteResponse(wr)
+	if ret != nil && ses.cw.compress {
+		wr.Write(ret)
+		return nil
+	}
+	return ret
+}
+
+// compressSession: stop read ahead output and terminate inner session
+func (ses *compressSession) Terminate() {
+	if ses.pipe != nil {
+		ses.pipe.stop()
+	}
+	ses.sesDecorator.Terminate()
+}
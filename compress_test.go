@@ -0,0 +1,162 @@
+/* General Web framework
+ * tests of transparent response compression
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// session which write body by chunks and flush
+type streamTestSession struct {
+	textTestSession
+	chunks []string
+	flush  bool
+	wait   chan bool // wait before last chunk if not nil
+}
+
+// streamTestSession: body
+func (ses *streamTestSession) WriteResponse(rsp io.Writer) []byte {
+	for i, chunk := range ses.chunks {
+		if ses.wait != nil && i == len(ses.chunks)-1 {
+			<-ses.wait
+		}
+		io.WriteString(rsp, chunk)
+		if fl, ok := rsp.(http.Flusher); ok && ses.flush {
+			fl.Flush()
+		}
+	}
+	return nil
+}
+
+// create compressed handler of session
+func newCompressTestHandler(ses func() QSession) http.HandlerFunc {
+	_, hnd := newTestHandler(CreateCompressHandle(CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			return ses()
+		})))
+	return hnd
+}
+
+// decode body of response by `Content-Encoding`
+func decodeTestBody(t *testing.T, rec *httptest.ResponseRecorder) string {
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		return rec.Body.String()
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCompressMinSize(t *testing.T) {
+	gzipHdr := http.Header{"Accept-Encoding": []string{"gzip"}}
+	large := strings.Repeat("compressible ", 300)
+	for _, c := range []struct {
+		chunks []string
+		gzip   bool
+	}{
+		{[]string{"small"}, false},
+		{[]string{"small", " body"}, false},
+		{[]string{large}, true},
+		{[]string{large[:100], large[100:2000], large[2000:]}, true},
+	} {
+		hnd := newCompressTestHandler(func() QSession {
+			return &streamTestSession{chunks: c.chunks}
+		})
+		rec := serveTest(hnd, "GET", "/", gzipHdr)
+		body := strings.Join(c.chunks, "")
+		if gz := rec.Header().Get("Content-Encoding") == "gzip"; gz != c.gzip {
+			t.Fatalf("body length %d, gzip %v", len(body), gz)
+		}
+		if dec := decodeTestBody(t, rec); dec != body {
+			t.Fatalf("body length %d, decoded length %d", len(body), len(dec))
+		}
+	}
+}
+
+func TestCompressStreamed(t *testing.T) {
+	wait := make(chan bool)
+	svr := httptest.NewServer(newCompressTestHandler(func() QSession {
+		return &streamTestSession{
+			chunks: []string{"first", "last"}, flush: true, wait: wait}
+	}))
+	defer svr.Close()
+	req, _ := http.NewRequest("GET", svr.URL+"/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rsp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("flushed response is not compressed")
+	}
+	gz, err := gzip.NewReader(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// first chunk is received before session write the last one
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(gz, buf); err != nil || string(buf) != "first" {
+		t.Fatalf("first chunk %q, %v", buf, err)
+	}
+	close(wait)
+	rest, err := ioutil.ReadAll(gz)
+	if err != nil || string(rest) != "last" {
+		t.Fatalf("rest %q, %v", rest, err)
+	}
+}
+
+func TestCompressLevel(t *testing.T) {
+	for _, level := range []int{-2, 0, 9} {
+		if err := checkCompressConf(CompressConf{Level: level}); err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+	}
+	for _, level := range []int{-3, 10} {
+		if err := checkCompressConf(CompressConf{Level: level}); err == nil {
+			t.Fatalf("level %d accepted", level)
+		}
+	}
+}
+
+func TestCompressETag(t *testing.T) {
+	large := strings.Repeat("compressible ", 300)
+	_, hnd := newTestHandler(CreateCompressHandle(CreateETagHandle(
+		CreateSimpHandle(func(inst QInstance, req SvrReq,
+			env interface{}) QSession {
+			return &textTestSession{large}
+		}))))
+	rec := serveTest(hnd, "GET", "/", nil)
+	identity := rec.Header().Get("ETag")
+	if identity == "" || strings.HasPrefix(identity, "W/") {
+		t.Fatalf("identity ETag %q", identity)
+	}
+	gzipHdr := http.Header{"Accept-Encoding": []string{"gzip"}}
+	rec = serveTest(hnd, "GET", "/", gzipHdr)
+	etag := rec.Header().Get("ETag")
+	if rec.Header().Get("Content-Encoding") != "gzip" ||
+		etag != "W/"+identity {
+		t.Fatalf("gzip ETag %q", etag)
+	}
+	gzipHdr.Set("If-None-Match", etag)
+	if rec = serveTest(hnd, "GET", "/", gzipHdr); rec.Code !=
+		http.StatusNotModified {
+		t.Fatalf("status %d", rec.Code)
+	}
+}
@@ -0,0 +1,214 @@
+/* General Web framework
+ * ETag and conditional request support
+ * Qujie Tech 2019-07-29
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// QSessionValidator is optional session interface which provide validators
+// of response. ETag can be quoted or not, empty ETag and zero time mean none
+type QSessionValidator interface {
+	ETag() string
+	LastModified() time.Time
+}
+
+// conditional request handle decorator, it implement QHandle
+type etagHandle struct {
+	hnd QHandle
+}
+
+// conditional request session decorator
+type etagSession struct {
+	sesDecorator
+	req      SvrReq
+	body     []byte // buffered body for hashed ETag
+	buffered bool   // mark body is buffered
+	status   int    // replaced status, 0 for inner response
+}
+
+// CreateETagHandle create a handle which answer conditional requests for GET
+// and HEAD sessions from hnd automatically, sessions of other methods are not
+// wrapped
+func CreateETagHandle(hnd QHandle) QHandle {
+	return &etagHandle{hnd}
+}
+
+// CreateETagSession wrap a session to answer conditional requests. validators
+// come from QSessionValidator or a hash of response body. for unsafe method,
+// `If-Match` and `If-Unmodified-Since` are checked by QSessionValidator before
+// inner EnterServer, and session without validator is not changed. HEAD
+// response without validator has no ETag because body is not available
+func CreateETagSession(req SvrReq, ses QSession) QSession {
+	return &etagSession{sesDecorator{ses}, req, nil, false, 0}
+}
+
+// quote entity-tag if need
+func quoteETag(etag string) string {
+	if etag == "" || strings.HasSuffix(etag, "\"") {
+		return etag
+	}
+	return "\"" + etag + "\""
+}
+
+// compare entity-tags, weak comparison ignore `W/` prefix
+func matchETag(a, b string, weak bool) bool {
+	if !weak && (strings.HasPrefix(a, "W/") || strings.HasPrefix(b, "W/")) {
+		return false
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// check method is safe for conditional request
+func isSafeMethod(method string) bool {
+	return method == MethodGET || method == MethodHEAD
+}
+
+// check entity-tag match a `If-Match` or `If-None-Match` list
+func matchETagList(list, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || matchETag(tag, etag, weak) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPreconditions evaluate conditional headers (RFC 7232) of request by
+// validators. it return 0 if request should proceed, or 304/412 status.
+// sessions with unsafe method can call it in EnterServer before any change
+func CheckPreconditions(req SvrReq, etag string, lastmod time.Time) int {
+	hdr := req.Header()
+	etag = quoteETag(etag)
+	lastmod = lastmod.Truncate(time.Second)
+	safe := isSafeMethod(req.Method())
+	if im := hdr.Get("If-Match"); im != "" {
+		if !matchETagList(im, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := hdr.Get("If-Unmodified-Since"); ius != "" &&
+		!lastmod.IsZero() {
+		if t, err := http.ParseTime(ius); err == nil && lastmod.After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if inm := hdr.Get("If-None-Match"); inm != "" {
+		if matchETagList(inm, etag, true) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims := hdr.Get("If-Modified-Since"); ims != "" && safe &&
+		!lastmod.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !lastmod.After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+//////////////////// etagHandle methods ////////////////////
+
+// etagHandle: init inner handle
+func (hnd *etagHandle) InitHandler(
+	inst QInstance, rte RouteHandle, ptree *RouteTree) {
+	hnd.hnd.InitHandler(inst, rte, ptree)
+}
+
+// etagHandle: create conditional session
+func (hnd *etagHandle) BeginSession(req SvrReq, env interface{}) QSession {
+	ses := hnd.hnd.BeginSession(req, env)
+	if ses == nil || !isSafeMethod(req.Method()) {
+		return ses
+	}
+	return CreateETagSession(req, ses)
+}
+
+//////////////////// etagSession methods ////////////////////
+
+// etagSession: check preconditions of unsafe method before inner session
+// make any change
+func (ses *etagSession) EnterServer() (redirect string, err error) {
+	if !isSafeMethod(ses.req.Method()) {
+		if vld, ok := ses.QSession.(QSessionValidator); ok {
+			cond := CheckPreconditions(ses.req, vld.ETag(), vld.LastModified())
+			if cond != 0 {
+				ses.status = cond
+				return "", nil
+			}
+		}
+	}
+	return ses.QSession.EnterServer()
+}
+
+// etagSession: evaluate conditional headers
+func (ses *etagSession) BeginResponse(header http.Header) (status int) {
+	if !isSafeMethod(ses.req.Method()) {
+		if ses.status != 0 {
+			return ses.status
+		}
+		return ses.QSession.BeginResponse(header)
+	}
+	status = ses.QSession.BeginResponse(header)
+	if status != http.StatusOK {
+		return status
+	}
+	var etag string
+	var lastmod time.Time
+	if vld, ok := ses.QSession.(QSessionValidator); ok {
+		etag = quoteETag(vld.ETag())
+		lastmod = vld.LastModified()
+	}
+	if etag == "" && lastmod.IsZero() {
+		if ses.req.Method() == MethodHEAD {
+			return status // body is not available to hash
+		}
+		buf := &bytes.Buffer{}
+		if ret := ses.QSession.WriteResponse(buf); ret != nil {
+			buf.Write(ret)
+		}
+		ses.body = buf.Bytes()
+		ses.buffered = true
+		hash := sha1.Sum(ses.body)
+		etag = "\"" + base64.RawURLEncoding.EncodeToString(hash[:]) + "\""
+	}
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if !lastmod.IsZero() {
+		header.Set("Last-Modified", lastmod.UTC().Format(http.TimeFormat))
+	}
+	if cond := CheckPreconditions(ses.req, etag, lastmod); cond != 0 {
+		ses.status = cond
+		header.Del("Content-Length")
+		header.Del("Content-Type")
+		return cond
+	}
+	return status
+}
+
+// etagSession: write inner or buffered response
+func (ses *etagSession) WriteResponse(rsp io.Writer) []byte {
+	if ses.status != 0 {
+		return nil
+	}
+	if ses.buffered {
+		return ses.body
+	}
+	return ses.QSession.WriteResponse(rsp)
+}
@@ -0,0 +1,87 @@
+/* General Web framework
+ * tests of conditional request support
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// session with validators which count changes
+type validatorTestSession struct {
+	textTestSession
+	changes *int
+}
+
+// validatorTestSession: make change
+func (ses *validatorTestSession) EnterServer() (string, error) {
+	*ses.changes++
+	return "", nil
+}
+
+// validatorTestSession: ETag
+func (ses *validatorTestSession) ETag() string {
+	return "v1"
+}
+
+// validatorTestSession: last modified
+func (ses *validatorTestSession) LastModified() time.Time {
+	return time.Time{}
+}
+
+func TestETagUnsafePrecondition(t *testing.T) {
+	changes := 0
+	_, hnd := newTestHandler(CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			return CreateETagSession(req,
+				&validatorTestSession{textTestSession{"done"}, &changes})
+		}))
+	rec := serveTest(hnd, "PUT", "/doc",
+		http.Header{"If-Match": []string{"\"v0\""}})
+	if rec.Code != http.StatusPreconditionFailed || changes != 0 {
+		t.Fatalf("status %d, changes %d", rec.Code, changes)
+	}
+	rec = serveTest(hnd, "DELETE", "/doc",
+		http.Header{"If-Match": []string{"\"v1\""}})
+	if rec.Code != http.StatusOK || changes != 1 {
+		t.Fatalf("status %d, changes %d", rec.Code, changes)
+	}
+}
+
+func TestETagHandleUnsafePassThrough(t *testing.T) {
+	_, hnd := newTestHandler(CreateETagHandle(CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			return &textTestSession{"done"}
+		})))
+	rec := serveTest(hnd, "POST", "/doc",
+		http.Header{"If-None-Match": []string{"*"}})
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != "" {
+		t.Fatalf("status %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestETagHashed(t *testing.T) {
+	_, hnd := newTestHandler(CreateETagHandle(CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			return &textTestSession{"content"}
+		})))
+	rec := serveTest(hnd, "GET", "/doc", nil)
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status %d, ETag %q", rec.Code, etag)
+	}
+	rec = serveTest(hnd, "GET", "/doc",
+		http.Header{"If-None-Match": []string{etag}})
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+	}
+	rec = serveTest(hnd, "HEAD", "/doc", nil)
+	if rec.Header().Get("ETag") != "" {
+		t.Fatalf("HEAD ETag %q", rec.Header().Get("ETag"))
+	}
+}
@@ -41,7 +41,9 @@ type redirSession struct {
 
 // inner redirect session
 type aliasSession struct {
-	route string
+	route  string
+	method string
+	values map[string]interface{}
 }
 
 // CreateFilesystemHandle create a static file handle
@@ -59,12 +61,20 @@ func CreateNochangeSession() QSession {
 	return &ht3xxSession{http.StatusNotModified}
 }
 
-// CreateAliasSession create a alias session
+// CreateAliasSession create a alias session. path can contain query string
+// to replace the query of request
 func CreateAliasSession(path string) QSession {
-	if path == "" {
-		path = "/"
+	return CreateAliasSessionEx(path, "", nil)
+}
+
+// CreateAliasSessionEx create a alias session with method override and
+// request-scoped values for next hop. empty method keep request method
+func CreateAliasSessionEx(
+	target, method string, values map[string]interface{}) QSession {
+	if target == "" {
+		target = "/"
 	}
-	return &aliasSession{path}
+	return &aliasSession{target, method, values}
 }
 
 //////////////////// fileHandle methods ////////////////////
@@ -103,6 +113,11 @@ func (ses *ht3xxSession) WriteResponse(rsp io.Writer) []byte {
 	return nil
 }
 
+// redirect resolve relative location by public scheme and host of request
+func (ses *redirSession) bindRequest(req SvrReq) {
+	ses.url = absoluteURL(req, ses.url)
+}
+
 // redirect BeginResponse
 func (ses *redirSession) BeginResponse(header http.Header) (status int) {
 	header.Add("Location", ses.url)
@@ -116,6 +131,16 @@ func (ses *aliasSession) EnterServer() (redirect string, err error) {
 	return ses.route, nil
 }
 
+// aliasSession RedirectMethod
+func (ses *aliasSession) RedirectMethod() string {
+	return ses.method
+}
+
+// aliasSession RedirectValues
+func (ses *aliasSession) RedirectValues() map[string]interface{} {
+	return ses.values
+}
+
 // aliasSession BeginResponse
 func (ses *aliasSession) BeginResponse(header http.Header) (status int) {
 	return http.StatusForbidden
@@ -7,7 +7,12 @@
 package wframe
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"html/template"
 	"io"
 	"net/http"
 )
@@ -54,10 +59,65 @@ var httpErrorTitles = map[int]string{
 	http.StatusNetworkAuthenticationRequired: "Network Authentication Required",
 }
 
+// media types of error response
+const (
+	errMediaHTML    = "text/html"
+	errMediaJSON    = "application/json"
+	errMediaProblem = "application/problem+json"
+)
+
 //Error handle and it work as a session
 type errHandle struct {
 	stateCode int
-	msg       []byte
+	title     string
+	msg       string
+	debug     *string
+	req       SvrReq                 // request for negotiation, nil if not bound
+	ext       map[string]interface{} // problem details extension members
+	plain     bool                   // message is plain text, escape in HTML
+}
+
+// HTTPError is an error with HTTP status code. framework response the status
+// (4xx/5xx) when session return it from EnterServer
+type HTTPError struct {
+	Code int    // HTTP status code
+	Msg  string // error message
+}
+
+// error which carry HTTP status code
+type statusCoder interface {
+	StatusCode() int
+}
+
+// error which carry extension members of problem details
+type problemError interface {
+	problemExt() map[string]interface{}
+}
+
+// ErrPageData is data object for custom error page template
+type ErrPageData struct {
+	Status    int           // HTTP status code
+	Title     string        // status title
+	Detail    string        // error message
+	Instance  string        // request URI
+	RequestID string        // request ID
+	Debug     template.HTML // request report in debug mode
+}
+
+// instance which provide custom error pages
+type errPageProvider interface {
+	errorPage(code int) *template.Template
+}
+
+// problem details object reference RFC 7807
+type errProblem struct {
+	Type      string                 `json:"type"`
+	Title     string                 `json:"title"`
+	Status    int                    `json:"status"`
+	Detail    string                 `json:"detail,omitempty"`
+	Instance  string                 `json:"instance,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Debug     map[string]interface{} `json:"debug,omitempty"`
 }
 
 // general error init
@@ -69,9 +129,25 @@ func (hnd *errHandle) InitHandler(
 // handle work as a session
 func (hnd *errHandle) BeginSession(
 	req SvrReq, env interface{}) QSession {
+	hnd.bindRequest(req)
 	return hnd
 }
 
+// bind request for content negotiation
+func (hnd *errHandle) bindRequest(req SvrReq) {
+	hnd.req = req
+}
+
+// check client prefer problem+json response
+func (hnd *errHandle) wantJSON() bool {
+	if hnd.req == nil {
+		return false
+	}
+	media := negotiateType(hnd.req.Header().Get("Accept"),
+		[]string{errMediaHTML, errMediaProblem, errMediaJSON})
+	return media == errMediaProblem || media == errMediaJSON
+}
+
 // general error response
 func (hnd *errHandle) EnterServer() (redirect string, err error) {
 	return "", nil
@@ -80,25 +156,158 @@ func (hnd *errHandle) EnterServer() (redirect string, err error) {
 // general error response
 func (hnd *errHandle) BeginResponse(header http.Header) (
 	status int) {
-	header.Add("Content-Type", "text/html;charset=utf-8")
+	header.Add("Vary", "Accept")
+	if hnd.wantJSON() {
+		header.Add("Content-Type", errMediaProblem)
+	} else {
+		header.Add("Content-Type", "text/html;charset=utf-8")
+	}
 	return hnd.stateCode
 }
 
 // general error output
 func (hnd *errHandle) WriteResponse(rsp io.Writer) []byte {
-	return hnd.msg
+	if hnd.wantJSON() {
+		return hnd.problemJSON()
+	}
+	return hnd.pageHTML()
 }
 
-// CreateErrSession make a default http error session
-func CreateErrSession(code int, msg string, debug *string) QSession {
-	title, ok := httpErrorTitles[code]
+// render error as HTML page
+func (hnd *errHandle) pageHTML() []byte {
+	if page := hnd.customPage(); page != nil {
+		return page
+	}
+	msg := hnd.msg
+	if hnd.plain {
+		msg = html.EscapeString(msg)
+	}
+	if hnd.debug != nil {
+		return []byte(fmt.Sprintf("<h1>%d %s</h1><p>%s</p>%s",
+			hnd.stateCode, hnd.title, msg, *hnd.debug))
+	}
+	return []byte(fmt.Sprintf("<h1>%d %s</h1><p>%s</p>",
+		hnd.stateCode, hnd.title, msg))
+}
+
+// render error with custom page template, nil if not configured
+func (hnd *errHandle) customPage() []byte {
+	if hnd.req == nil {
+		return nil
+	}
+	provider, ok := hnd.req.frmInst().(errPageProvider)
 	if !ok {
 		return nil
 	}
-	if debug != nil {
-		msg = fmt.Sprintf("<h1>%d %s</h1><p>%s</p>%s", code, title, msg, *debug)
-	} else {
-		msg = fmt.Sprintf("<h1>%d %s</h1><p>%s</p>", code, title, msg)
+	tmpl := provider.errorPage(hnd.stateCode)
+	if tmpl == nil {
+		return nil
+	}
+	data := ErrPageData{
+		Status:    hnd.stateCode,
+		Title:     hnd.title,
+		Detail:    hnd.msg,
+		Instance:  hnd.req.RawReq().URL.RequestURI(),
+		RequestID: hnd.req.RequestID(),
+	}
+	if hnd.debug != nil {
+		data.Debug = template.HTML(*hnd.debug)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, &data); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// render error as problem details JSON
+func (hnd *errHandle) problemJSON() []byte {
+	prob := errProblem{
+		Type:   "about:blank",
+		Title:  hnd.title,
+		Status: hnd.stateCode,
+		Detail: hnd.msg,
+	}
+	if hnd.req != nil {
+		prob.Instance = hnd.req.RawReq().URL.RequestURI()
+		prob.RequestID = hnd.req.RequestID()
+		if hnd.debug != nil {
+			prob.Debug = hnd.req.debugInfo()
+		}
+	}
+	ret, err := json.Marshal(&prob)
+	if err == nil && len(hnd.ext) > 0 {
+		ret, err = mergeProblemExt(ret, hnd.ext)
+	}
+	if err != nil {
+		return []byte(fmt.Sprintf(
+			"{\"type\":\"about:blank\",\"status\":%d}", hnd.stateCode))
+	}
+	return ret
+}
+
+// add extension members to problem details JSON, standard members are kept
+func mergeProblemExt(prob []byte, ext map[string]interface{}) ([]byte, error) {
+	members := make(map[string]interface{})
+	if err := json.Unmarshal(prob, &members); err != nil {
+		return nil, err
+	}
+	for k, v := range ext {
+		if _, ok := members[k]; !ok {
+			members[k] = v
+		}
+	}
+	return json.Marshal(members)
+}
+
+// HTTPError: error message
+func (e *HTTPError) Error() string {
+	return e.Msg
+}
+
+// HTTPError: status code
+func (e *HTTPError) StatusCode() int {
+	return e.Code
+}
+
+// get title of error status code. unknown code use a class title
+func errStatusTitle(code int) string {
+	if title, ok := httpErrorTitles[code]; ok {
+		return title
+	}
+	if title := http.StatusText(code); title != "" {
+		return title
+	}
+	if code < 500 {
+		return "Client Error"
+	}
+	return "Server Error"
+}
+
+// CreateErrSession make a default http error session. the response is HTML
+// page or `application/problem+json` (RFC 7807) according to `Accept` header.
+// code out of 4xx/5xx is replaced by 500
+func CreateErrSession(code int, msg string, debug *string) QSession {
+	if code < 400 || code > 599 {
+		code = http.StatusInternalServerError
+	}
+	return &errHandle{code, errStatusTitle(code), msg, debug, nil, nil, false}
+}
+
+// make error session from error which carry 4xx/5xx status code (see
+// HTTPError), ok is false for other errors. message of error is responded as
+// plain text, and extension members are added to problem details
+func errSessionFromErr(err error, debug *string) (ses QSession, ok bool) {
+	var sterr statusCoder
+	if !errors.As(err, &sterr) || sterr.StatusCode() < 400 ||
+		sterr.StatusCode() > 599 {
+		return nil, false
+	}
+	hnd := &errHandle{sterr.StatusCode(), errStatusTitle(sterr.StatusCode()),
+		err.Error(), debug, nil, nil, true}
+	var perr problemError
+	if errors.As(err, &perr) {
+		hnd.ext = perr.problemExt()
 	}
-	return &errHandle{code, []byte(msg)}
+	return hnd, true
 }
@@ -0,0 +1,316 @@
+/* General Web framework
+ * client address, scheme and host behind trusted proxies
+ * Qujie Tech 2019-09-02
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// valid host forwarded by proxy
+var matchFwdHost = regexp.MustCompile(
+	"^([a-zA-Z0-9._-]+|\\[[0-9a-fA-F:.]+\\])(:[0-9]{1,5})?$")
+
+// context key of forwarded info for sub-request
+type forwardKey struct{}
+
+// trusted proxy networks
+type proxyTrust []*net.IPNet
+
+// instance which trust proxies
+type proxyTrustInstance interface {
+	trustedProxies() proxyTrust
+}
+
+// a proxy hop from `Forwarded` or `X-Forwarded-*` headers
+type forwardHop struct {
+	ip    net.IP // node address, nil for unknown or obfuscated node
+	proto string // scheme which proxy received
+	host  string // host which proxy received
+}
+
+// client information resolved through trusted proxies
+type forwardInfo struct {
+	clientIP string
+	scheme   string
+	host     string
+}
+
+// parse trusted proxies config, item is a CIDR or an IP address
+func parseTrustedProxies(list []string) (proxyTrust, error) {
+	trust := make(proxyTrust, 0, len(list))
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if strings.Contains(item, "/") {
+			_, ipnet, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", item)
+			}
+			trust = append(trust, ipnet)
+			continue
+		}
+		ip := net.ParseIP(item)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", item)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		bits := len(ip) * 8
+		trust = append(trust, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return trust, nil
+}
+
+// check header which trusted proxies set, it is `Forwarded` or
+// `X-Forwarded-For`
+func checkProxyHeader(name string) (string, error) {
+	switch name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name {
+	case "Forwarded", "X-Forwarded-For":
+		return name, nil
+	}
+	return "", fmt.Errorf("invalid proxy header %q", name)
+}
+
+// parse node address, it can be IP, IP with port or bracketed IPv6
+func parseNodeIP(node string) net.IP {
+	node = strings.TrimSpace(node)
+	if ip := net.ParseIP(node); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return net.ParseIP(host)
+	}
+	if strings.HasPrefix(node, "[") && strings.HasSuffix(node, "]") {
+		return net.ParseIP(node[1 : len(node)-1])
+	}
+	return nil
+}
+
+// split header value by sep, quoted string is kept
+func splitQuoted(s string, sep byte) []string {
+	var ret []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			ret = append(ret, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(ret, s[start:])
+}
+
+// remove quotes of a quoted string
+func unquoteValue(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// check scheme forwarded by proxy
+func fwdScheme(proto string) string {
+	switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+	case "http", "https":
+		return proto
+	}
+	return ""
+}
+
+// check host forwarded by proxy
+func fwdHost(host string) string {
+	if host = strings.TrimSpace(host); matchFwdHost.MatchString(host) {
+		return host
+	}
+	return ""
+}
+
+// items of comma separated header
+func headerItems(header http.Header, name string) []string {
+	values := header[name]
+	if len(values) == 0 {
+		return nil
+	}
+	return strings.Split(strings.Join(values, ","), ",")
+}
+
+// proxy hops in `Forwarded` header (RFC 7239), in order of header
+func forwardedHops(header http.Header) []forwardHop {
+	values := header["Forwarded"]
+	if len(values) == 0 {
+		return nil
+	}
+	hops := make([]forwardHop, 0)
+	for _, elem := range splitQuoted(strings.Join(values, ","), ',') {
+		hop := forwardHop{}
+		for _, pair := range splitQuoted(elem, ';') {
+			pos := strings.Index(pair, "=")
+			if pos < 0 {
+				continue
+			}
+			val := unquoteValue(strings.TrimSpace(pair[pos+1:]))
+			switch strings.ToLower(strings.TrimSpace(pair[:pos])) {
+			case "for":
+				hop.ip = parseNodeIP(val)
+			case "proto":
+				hop.proto = fwdScheme(val)
+			case "host":
+				hop.host = fwdHost(val)
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// proxy hops in `X-Forwarded-For` header, in order of header. items of
+// `X-Forwarded-Proto` and `X-Forwarded-Host` are appended by same proxies, so
+// they are aligned to hops from the nearest one
+func xForwardedHops(header http.Header) []forwardHop {
+	nodes := headerItems(header, "X-Forwarded-For")
+	if len(nodes) == 0 {
+		return nil
+	}
+	protos := headerItems(header, "X-Forwarded-Proto")
+	hosts := headerItems(header, "X-Forwarded-Host")
+	hops := make([]forwardHop, len(nodes))
+	for i, node := range nodes {
+		hops[i].ip = parseNodeIP(node)
+		if j := i - len(nodes) + len(protos); j >= 0 {
+			hops[i].proto = fwdScheme(protos[j])
+		}
+		if j := i - len(nodes) + len(hosts); j >= 0 {
+			hops[i].host = fwdHost(hosts[j])
+		}
+	}
+	return hops
+}
+
+// resolve client through trusted proxies. hops in header which trusted
+// proxies set are walked from the nearest one, the first untrusted node is the
+// client, and scheme and host are taken from the hop where walk stopped, or
+// from the trusted hop next to it if absent
+func resolveForward(
+	trust proxyTrust, header string, req *http.Request) *forwardInfo {
+	info := &forwardInfo{accessHost(req.RemoteAddr), "http", req.Host}
+	if req.TLS != nil {
+		info.scheme = "https"
+	}
+	peer := parseNodeIP(req.RemoteAddr)
+	if peer == nil || !trust.contains(peer) {
+		return info
+	}
+	info.clientIP = peer.String()
+	var hops []forwardHop
+	if header == "Forwarded" {
+		hops = forwardedHops(req.Header)
+	} else {
+		hops = xForwardedHops(req.Header)
+	}
+	stop := -1
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].ip == nil {
+			break // unknown node can not be trusted
+		}
+		stop = i
+		if !trust.contains(hops[i].ip) {
+			break
+		}
+	}
+	if stop < 0 {
+		return info
+	}
+	info.clientIP = hops[stop].ip.String()
+	// scheme and host of client hop, or nearest trusted hop which has them
+	// if proxy in front set only one item
+	proto, host := "", ""
+	for _, hop := range hops[stop:] {
+		if proto == "" {
+			proto = hop.proto
+		}
+		if host == "" {
+			host = hop.host
+		}
+	}
+	if proto != "" {
+		info.scheme = proto
+	}
+	if host != "" {
+		info.host = host
+	}
+	return info
+}
+
+// forwarded info of request, sub-request inherit it from parent request
+func requestForward(inst QInstance, req *http.Request) *forwardInfo {
+	if fwd, ok := req.Context().Value(forwardKey{}).(*forwardInfo); ok {
+		return fwd
+	}
+	var trust proxyTrust
+	if pti, ok := inst.(proxyTrustInstance); ok {
+		trust = pti.trustedProxies()
+	}
+	return resolveForward(trust, inst.InstConf().ProxyHeader, req)
+}
+
+// resolve a relative URL reference against public URL of request
+func absoluteURL(req SvrReq, ref string) string {
+	refURL, err := url.Parse(ref)
+	if err != nil || refURL.IsAbs() || strings.HasPrefix(ref, "//") ||
+		req.HostName() == "" {
+		return ref
+	}
+	base, err := url.ParseRequestURI(req.RawReq().RequestURI)
+	if err != nil {
+		base = &url.URL{Path: "/"}
+	}
+	base.Scheme, base.Host = req.Scheme(), req.HostName()
+	return base.ResolveReference(refURL).String()
+}
+
+//////////////////// proxyTrust methods ////////////////////
+
+// proxyTrust: check address is a trusted proxy
+func (trust proxyTrust) contains(ip net.IP) bool {
+	for _, ipnet := range trust {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//////////////////// svrRspObj forwarded info ////////////////////
+
+// client IP, it is resolved through trusted proxies
+func (srq *svrRspObj) ClientIP() string {
+	return srq.fwd.clientIP
+}
+
+// public scheme (`http` or `https`), it is forwarded by trusted proxies
+func (srq *svrRspObj) Scheme() string {
+	return srq.fwd.scheme
+}
@@ -0,0 +1,86 @@
+/* General Web framework
+ * tests of client information behind trusted proxies
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveForward(t *testing.T) {
+	trust, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		header string // proxy header
+		remote string
+		hdr    map[string]string
+		client string
+		scheme string
+		host   string
+	}{
+		{"untrusted peer", "X-Forwarded-For", "1.1.1.1:1000",
+			map[string]string{"X-Forwarded-For": "2.2.2.2",
+				"X-Forwarded-Proto": "https", "X-Forwarded-Host": "other"},
+			"1.1.1.1", "http", "example.com"},
+		{"single proxy", "X-Forwarded-For", "10.0.0.1:1000",
+			map[string]string{"X-Forwarded-For": "2.2.2.2",
+				"X-Forwarded-Proto": "https", "X-Forwarded-Host": "pub.example"},
+			"2.2.2.2", "https", "pub.example"},
+		{"spoofed prefix", "X-Forwarded-For", "10.0.0.1:1000",
+			map[string]string{"X-Forwarded-For": "6.6.6.6, 2.2.2.2, 10.0.0.2",
+				"X-Forwarded-Proto": "http, https, http",
+				"X-Forwarded-Host":  "evil.example, pub.example, inner"},
+			"2.2.2.2", "https", "pub.example"},
+		{"obfuscated node", "X-Forwarded-For", "10.0.0.1:1000",
+			map[string]string{"X-Forwarded-For": "2.2.2.2, unknown, 10.0.0.2"},
+			"10.0.0.2", "http", "example.com"},
+		{"fewer proto items", "X-Forwarded-For", "10.0.0.1:1000",
+			map[string]string{"X-Forwarded-For": "2.2.2.2, 10.0.0.2",
+				"X-Forwarded-Proto": "https"},
+			"2.2.2.2", "https", "example.com"},
+		{"IPv6 with port", "X-Forwarded-For", "[2001:db8::1]:1000",
+			map[string]string{"X-Forwarded-For": "[2001:db8::5]:4711"},
+			"2001:db8::5", "http", "example.com"},
+		{"invalid proto and host", "X-Forwarded-For", "10.0.0.1:1000",
+			map[string]string{"X-Forwarded-For": "2.2.2.2",
+				"X-Forwarded-Proto": "javascript", "X-Forwarded-Host": "a/b"},
+			"2.2.2.2", "http", "example.com"},
+		{"forwarded ignored", "X-Forwarded-For", "10.0.0.1:1000",
+			map[string]string{"Forwarded": "for=3.3.3.3;proto=https"},
+			"10.0.0.1", "http", "example.com"},
+		{"forwarded", "Forwarded", "10.0.0.1:1000",
+			map[string]string{
+				"Forwarded": `for=6.6.6.6, for="[2001:db8::5]:80";proto=https` +
+					`;host=pub.example, for=10.0.0.2`,
+				"X-Forwarded-For": "3.3.3.3"},
+			"2001:db8::5", "https", "pub.example"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		for k, v := range c.hdr {
+			req.Header.Set(k, v)
+		}
+		info := resolveForward(trust, c.header, req)
+		if info.clientIP != c.client || info.scheme != c.scheme ||
+			info.host != c.host {
+			t.Errorf("%s: got %+v", c.name, info)
+		}
+	}
+}
+
+func TestCheckProxyHeader(t *testing.T) {
+	if name, err := checkProxyHeader("forwarded"); err != nil ||
+		name != "Forwarded" {
+		t.Fatalf("%q, %v", name, err)
+	}
+	if _, err := checkProxyHeader("X-Real-IP"); err == nil {
+		t.Fatal("X-Real-IP accepted")
+	}
+}
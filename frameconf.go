@@ -23,6 +23,26 @@ type InstConfig struct {
 	Includes    map[string]string     `yaml:"Includes,omitempty"`
 	Logs        map[string]frmLogConf `yaml:"Logs,omitempty"`
 	Debuging    bool                  `yaml:"DebugInterface,omitempty"`
+	ErrorPages  map[int]string        `yaml:"ErrorPages,omitempty"`
+	Compress    CompressConf          `yaml:"Compress,omitempty"`
+	RequestID   RequestIDConf         `yaml:"RequestID,omitempty"`
+	BufferBody  bool                  `yaml:"BufferBody,omitempty"`
+	Proxies     []string              `yaml:"TrustedProxies,omitempty"`
+	ProxyHeader string                `yaml:"ProxyHeader,omitempty"`
+}
+
+// RequestIDConf defined request ID options
+type RequestIDConf struct {
+	Header string `yaml:"header,omitempty"` // request and response header
+	Trust  bool   `yaml:"trust,omitempty"`  // accept ID from client headers
+}
+
+// CompressConf defined response compression options
+type CompressConf struct {
+	MinSize   int64    `yaml:"min_size,omitempty"`   // min body size
+	Level     int      `yaml:"level,omitempty"`      // compress level
+	Types     []string `yaml:"types,omitempty"`      // compress types only
+	SkipTypes []string `yaml:"skip_types,omitempty"` // not compress types
 }
 
 ////////////////////// functions //////////////////////
@@ -37,6 +57,12 @@ func newFrmConf() *InstConfig {
 		nil,
 		nil,
 		false,
+		nil,
+		CompressConf{1024, 0, nil, nil},
+		RequestIDConf{defaultReqIDHeader, false},
+		false,
+		nil,
+		"X-Forwarded-For",
 	}
 }
 
@@ -7,11 +7,11 @@
 package wframe
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"runtime/debug"
+	"time"
 )
 
 // QSession defined basic session interface in framework
@@ -26,23 +26,67 @@ type QSessionEx interface {
 	Terminate()
 }
 
+// QSessionRedirectHook is optional session interface. it is called when
+// session require an inner redirect, before the session be terminated
+type QSessionRedirectHook interface {
+	OnRedirect(target string)
+}
+
+// QSessionInnerRedirect is optional session interface to extend the inner
+// redirect returned by EnterServer. method is kept if RedirectMethod return
+// empty, values are set to request-scoped values before next hop
+type QSessionInnerRedirect interface {
+	RedirectMethod() string
+	RedirectValues() map[string]interface{}
+}
+
+// QSessionErrorHook is optional session interface. it is called when session
+// return an error or panic in it life
+type QSessionErrorHook interface {
+	OnError(err error)
+}
+
+// QSessionResponseHook is optional session interface. it is called after
+// response finished and before session be terminated
+type QSessionResponseHook interface {
+	AfterResponse(status int, written int64, duration time.Duration,
+		writeErr error)
+}
+
+// session which need the request object before response
+type reqBindSession interface {
+	bindRequest(req SvrReq)
+}
+
+// base of session decorator. it forward optional interfaces to inner session
+type sesDecorator struct {
+	QSession
+}
+
 // QHandle defined basic service handler interface in framework
 type QHandle interface {
 	InitHandler(inst QInstance, rte RouteHandle, ptree *RouteTree)
 	BeginSession(req SvrReq, env interface{}) QSession
 }
 
-// raw ResponseWriter adapter for framework. it implement ResponseWriter
+// raw ResponseWriter adapter for framework. it implement ResponseWriter.
+// status from raw handle is deferred until first write or framework response
 type rawRspAdaper struct {
-	rawrsp http.ResponseWriter
-	//frmhandle *rawHandler
-	startrep  chan bool // tell framework start response
-	allowrep  chan bool // tell handle to write response
-	endrep    chan bool //tell write complete to write response
-	started   bool      // mark response is started
-	writeable bool      // mrak response is writeable
-	status    int
-	err       error
+	rawrsp      http.ResponseWriter
+	status      int  // response status
+	wroteHeader bool // mark status is set by raw handle
+	committed   bool // mark header is sent to client
+	hijacked    bool // mark connection is hijacked by raw handle
+}
+
+// framework ResponseWriter. it record response state for session hooks
+type frmRspWriter struct {
+	rsp         http.ResponseWriter
+	status      int   // response status
+	written     int64 // size of written body
+	wroteHeader bool  // mark header is written
+	hijacked    bool  // mark connection is hijacked
+	err         error // first error in write
 }
 
 // Raw handle adapter. it implement QHandle
@@ -50,11 +94,12 @@ type rawHandler struct {
 	rawfunc func(http.ResponseWriter, *http.Request)
 }
 
-// Session of raw handle adapter, it implement QSession
+// Session of raw handle adapter, it implement QSession. raw handle is
+// executed synchronously in EnterServer
 type rawSession struct {
-	rawfunc  func(http.ResponseWriter, *http.Request)
-	req      SvrReq
-	rspstart *rawRspAdaper
+	rawfunc func(http.ResponseWriter, *http.Request)
+	req     SvrReq
+	rsp     *rawRspAdaper
 }
 
 // simple handle, it only create specify session
@@ -77,41 +122,89 @@ func getSessionEnv(inst QInstance, req SvrReq) interface{} {
 // QHandle2HandlerFunc convert QHandle to HandlerFunc
 func QHandle2HandlerFunc(hnd QHandle, inst QInstance) func(
 	rsp http.ResponseWriter, req *http.Request) {
-	var sndlog func(QLogLevel, string)
-	sndlog = inst.Log("error")
-	if sndlog == nil {
-		sndlog = func(level QLogLevel, msg string) {
+	var errlog func(QLogLevel, string)
+	errlog = inst.Log("error")
+	if errlog == nil {
+		errlog = func(level QLogLevel, msg string) {
 			fmt.Println(msg)
 		}
 	}
-	// extension session terminate
-	exSesTerm := func(ses QSession) {
+	// call session method safety
+	safeCall := func(sndlog func(QLogLevel, string), desc string, f func()) {
 		defer (func() {
 			if err := recover(); err != nil {
 				sndlog(LQLogERROR, fmt.Sprintf(
-					"A big error in session terminate - %q\n%s",
-					err, string(debug.Stack())))
+					"A big error in session %s - %q\n%s",
+					desc, err, string(debug.Stack())))
 			}
 		})()
+		f()
+	}
+	// extension session terminate
+	exSesTerm := func(sndlog func(QLogLevel, string), ses QSession) {
 		sesex, ok := ses.(QSessionEx)
 		if !ok {
 			return
 		}
-		sesex.Terminate()
-		//TODO: append more support termnate method here
-		return
+		safeCall(sndlog, "terminate", sesex.Terminate)
+	}
+	// extension session redirect
+	exSesRedir := func(
+		sndlog func(QLogLevel, string), ses QSession, target string) {
+		if hook, ok := ses.(QSessionRedirectHook); ok {
+			safeCall(sndlog, "redirect hook", func() { hook.OnRedirect(target) })
+		}
+	}
+	// extension session error
+	exSesErr := func(sndlog func(QLogLevel, string), ses QSession, err error) {
+		if hook, ok := ses.(QSessionErrorHook); ok {
+			safeCall(sndlog, "error hook", func() { hook.OnError(err) })
+		}
+	}
+	// extension session after response
+	exSesAfter := func(sndlog func(QLogLevel, string), ses QSession,
+		rsp *frmRspWriter, start time.Time) {
+		if hook, ok := ses.(QSessionResponseHook); ok {
+			safeCall(sndlog, "response hook", func() {
+				hook.AfterResponse(
+					rsp.status, rsp.written, time.Since(start), rsp.err)
+			})
+		}
+	}
+	// write access log of request, sub-request is not logged
+	exAccessLog := func(reqobj SvrReq, method string, rsp *frmRspWriter,
+		start time.Time) {
+		alog, ok := inst.(accessLogInstance)
+		if !ok || subReqDepth(reqobj.RawReq().Context()) > 0 {
+			return
+		}
+		rawreq := reqobj.RawReq()
+		uri := rawreq.RequestURI
+		if uri == "" {
+			uri = rawreq.URL.RequestURI()
+		}
+		alog.accessLog(&accessRecord{
+			start, reqobj.ClientIP(), method, uri, rawreq.Proto,
+			rsp.status, rsp.written, time.Since(start),
+			rawreq.UserAgent(), rawreq.Referer(), reqobj.RequestID(),
+		})
 	}
 	// init handle
 	hnd.InitHandler(inst, nil, nil)
 	// create session and process redirect
 	maxRdir := inst.InstConf().MaxRedirect
-	createSession := func(reqobj SvrReq) (ses QSession) {
+	idConf := inst.InstConf().RequestID
+	idHeader := reqIDHeader(&idConf)
+	createSession := func(
+		reqobj SvrReq, sndlog func(QLogLevel, string)) (ses QSession) {
+		var cur QSession // session in processing
 		defer (func() {
 			if err := recover(); err != nil {
 				sndlog(LQLogERROR, fmt.Sprintf(
 					"A big error - %q\n%s", err, string(debug.Stack())))
-				if ses != nil {
-					exSesTerm(ses)
+				if cur != nil {
+					exSesErr(sndlog, cur, panicErr(err))
+					exSesTerm(sndlog, cur)
 				}
 				ses = CreateErrSession(
 					http.StatusInternalServerError, "Big Errorrrrrrr", nil)
@@ -134,17 +227,36 @@ func QHandle2HandlerFunc(hnd QHandle, inst QInstance) func(
 				return CreateErrSession(
 					http.StatusInternalServerError, "an error occured", reqinfoFunc())
 			}
+			cur = ses
 			rdir, err := ses.EnterServer()
+			cur = nil
 			if rdir != "" || err != nil {
 				defer (func() {
 					xses := ses
 					ses = nil
-					exSesTerm(xses)
+					exSesTerm(sndlog, xses)
 				})()
 				if rdir != "" {
-					reqobj.redirect(splitePath(rdir))
+					exSesRedir(sndlog, ses, rdir)
+					method := ""
+					if irdir, ok := ses.(QSessionInnerRedirect); ok {
+						method = irdir.RedirectMethod()
+						for k, v := range irdir.RedirectValues() {
+							reqobj.SetValue(k, v)
+						}
+					}
+					reqobj.redirect(rdir, method)
 					continue
 				} else if err != nil {
+					exSesErr(sndlog, ses, err)
+					if eses, ok := errSessionFromErr(err, reqinfoFunc()); ok {
+						level := LQLogERROR
+						if eses.(*errHandle).stateCode < 500 {
+							level = LQLogWARN
+						}
+						sndlog(level, fmt.Sprintf("handler error - %q", err))
+						return eses
+					}
 					sndlog(LQLogERROR, fmt.Sprintf("handler error - %q", err))
 					return CreateErrSession(
 						http.StatusInternalServerError, "an error occured", reqinfoFunc())
@@ -158,14 +270,37 @@ func QHandle2HandlerFunc(hnd QHandle, inst QInstance) func(
 	}
 	// export
 	return func(rsp http.ResponseWriter, req *http.Request) {
-		reqobj := createReqObj(inst, rsp, req)
-		ses := createSession(reqobj)
-		defer exSesTerm(ses)
-		state := ses.BeginResponse(rsp.Header())
-		rsp.WriteHeader(state)
-		ret := ses.WriteResponse(rsp)
+		start := time.Now()
+		frmrsp := &frmRspWriter{rsp: rsp}
+		reqobj := createReqObj(inst, frmrsp, req)
+		defer exAccessLog(reqobj, req.Method, frmrsp, start)
+		if rel, ok := reqobj.(reqReleaser); ok {
+			defer rel.release()
+		}
+		sndlog := reqIDLogger(errlog, reqobj.RequestID())
+		frmrsp.Header().Set(idHeader, reqobj.RequestID())
+		ses := CreateRangeSession(reqobj, createSession(reqobj, sndlog))
+		defer exSesTerm(sndlog, ses)
+		defer exSesAfter(sndlog, ses, frmrsp, start)
+		defer (func() {
+			if err := recover(); err != nil {
+				sndlog(LQLogERROR, fmt.Sprintf(
+					"A big error in response - %q\n%s", err, string(debug.Stack())))
+				exSesErr(sndlog, ses, panicErr(err))
+			}
+		})()
+		if frmrsp.wroteHeader {
+			// response already committed or hijacked by raw handle in EnterServer
+			return
+		}
+		if rbses, ok := ses.(reqBindSession); ok {
+			rbses.bindRequest(reqobj)
+		}
+		state := ses.BeginResponse(frmrsp.Header())
+		frmrsp.WriteHeader(state)
+		ret := ses.WriteResponse(frmrsp)
 		if ret != nil {
-			_, err := rsp.Write(ret)
+			_, err := frmrsp.Write(ret)
 			if err != nil {
 				sndlog(LQLogERROR, fmt.Sprintf("handler error - %q", err))
 			}
@@ -173,6 +308,14 @@ func QHandle2HandlerFunc(hnd QHandle, inst QInstance) func(
 	}
 }
 
+// convert recovered panic value to error
+func panicErr(err interface{}) error {
+	if errobj, ok := err.(error); ok {
+		return errobj
+	}
+	return fmt.Errorf("%q", err)
+}
+
 // HandleFunc2QHandle convert HandleFunc to QHandle
 func HandleFunc2QHandle(
 	hndf func(http.ResponseWriter, *http.Request)) QHandle {
@@ -208,57 +351,36 @@ func (hnd *rawHandler) BeginSession(
 
 // rawHandler: access
 func (ses *rawSession) EnterServer() (redirect string, err error) {
-	adapter := &rawRspAdaper{
-		ses.req.rawRsp(),
-		//ses,
-		make(chan bool),
-		make(chan bool),
-		make(chan bool),
-		false,
-		false,
-		http.StatusOK,
-		nil,
-	}
-	go (func() {
-		defer (func() {
-			if err := recover(); err != nil {
-				if errobj, ok := err.(error); ok {
-					adapter.err = errobj
-				} else {
-					adapter.err = fmt.Errorf("%q", err)
-				}
-				close(adapter.endrep)
-				close(adapter.startrep)
-			} else {
-				if !adapter.writeable {
-					adapter.Write(nil)
-				}
-			}
-		})()
-		ses.rawfunc(adapter, ses.req.RawReq())
-		close(adapter.endrep)
+	ses.rsp = &rawRspAdaper{
+		ses.req.rawRsp(), http.StatusOK, false, false, false}
+	defer (func() {
+		if perr := recover(); perr != nil {
+			err = panicErr(perr)
+		}
 	})()
-	<-adapter.startrep //wait reponse
-	ses.rspstart = adapter
-	if adapter.err != nil {
-		close(adapter.allowrep)
-		return "", adapter.err
-	}
+	ses.rawfunc(wrapRawAdapter(ses.rsp), ses.req.RawReq())
 	return "", nil
 }
 
 // rawHandler: start response
 func (ses *rawSession) BeginResponse(header http.Header) (status int) {
-	return ses.rspstart.status
+	return ses.rsp.status
 }
 
 // rawHandler: write data
 func (ses *rawSession) WriteResponse(rsp io.Writer) []byte {
-	ses.rspstart.allowrep <- true
-	<-ses.rspstart.endrep
 	return nil
 }
 
+// rawRspAdaper: commit header to raw response
+func (adp *rawRspAdaper) commit() {
+	if adp.committed {
+		return
+	}
+	adp.committed = true
+	adp.rawrsp.WriteHeader(adp.status)
+}
+
 // rawRspAdaper: ResponseWriter.Header
 func (adp *rawRspAdaper) Header() http.Header {
 	return adp.rawrsp.Header()
@@ -266,31 +388,111 @@ func (adp *rawRspAdaper) Header() http.Header {
 
 // rawRspAdaper: ResponseWriter.Write
 func (adp *rawRspAdaper) Write(data []byte) (int, error) {
-	if !adp.started {
-		adp.startrep <- true
-		adp.started = true
-	}
-	if !adp.writeable {
-		_, ok := <-adp.allowrep
-		if !ok && adp.err == nil {
-			adp.err = errors.New("Can not write data. an error occured in framework")
-		}
-		adp.writeable = true
+	if adp.hijacked {
+		return 0, http.ErrHijacked
 	}
-	if adp.err != nil {
-		return 0, adp.err
+	adp.wroteHeader = true
+	adp.commit()
+	if len(data) < 1 {
+		return 0, nil
 	}
-	if data != nil {
-		return adp.rawrsp.Write(data)
-	}
-	return 0, nil
+	return adp.rawrsp.Write(data)
 }
 
-// rawRspAdaper: ResponseWriter.WriteHeader
+// rawRspAdaper: ResponseWriter.WriteHeader. only first status is available
 func (adp *rawRspAdaper) WriteHeader(statusCode int) {
+	if adp.wroteHeader {
+		return
+	}
+	adp.wroteHeader = true
 	adp.status = statusCode
-	adp.startrep <- true
-	adp.started = true
+}
+
+////////////////////////// sesDecorator methods //////////////////////////
+
+// sesDecorator: forward QSessionEx
+func (d *sesDecorator) Terminate() {
+	if ex, ok := d.QSession.(QSessionEx); ok {
+		ex.Terminate()
+	}
+}
+
+// sesDecorator: forward QSessionRedirectHook
+func (d *sesDecorator) OnRedirect(target string) {
+	if hook, ok := d.QSession.(QSessionRedirectHook); ok {
+		hook.OnRedirect(target)
+	}
+}
+
+// sesDecorator: forward QSessionInnerRedirect
+func (d *sesDecorator) RedirectMethod() string {
+	if irdir, ok := d.QSession.(QSessionInnerRedirect); ok {
+		return irdir.RedirectMethod()
+	}
+	return ""
+}
+
+// sesDecorator: forward QSessionInnerRedirect
+func (d *sesDecorator) RedirectValues() map[string]interface{} {
+	if irdir, ok := d.QSession.(QSessionInnerRedirect); ok {
+		return irdir.RedirectValues()
+	}
+	return nil
+}
+
+// sesDecorator: forward QSessionErrorHook
+func (d *sesDecorator) OnError(err error) {
+	if hook, ok := d.QSession.(QSessionErrorHook); ok {
+		hook.OnError(err)
+	}
+}
+
+// sesDecorator: forward QSessionResponseHook
+func (d *sesDecorator) AfterResponse(status int, written int64,
+	duration time.Duration, writeErr error) {
+	if hook, ok := d.QSession.(QSessionResponseHook); ok {
+		hook.AfterResponse(status, written, duration, writeErr)
+	}
+}
+
+// sesDecorator: forward request binding
+func (d *sesDecorator) bindRequest(req SvrReq) {
+	if rbses, ok := d.QSession.(reqBindSession); ok {
+		rbses.bindRequest(req)
+	}
+}
+
+////////////////////////// frmRspWriter methods //////////////////////////
+
+// frmRspWriter: ResponseWriter.Header
+func (w *frmRspWriter) Header() http.Header {
+	return w.rsp.Header()
+}
+
+// frmRspWriter: ResponseWriter.WriteHeader. only first status is written
+func (w *frmRspWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = statusCode
+	w.rsp.WriteHeader(statusCode)
+}
+
+// frmRspWriter: ResponseWriter.Write
+func (w *frmRspWriter) Write(data []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	wlen, err := w.rsp.Write(data)
+	w.written += int64(wlen)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return wlen, err
 }
 
 ////////////////////////// simpHandle methods //////////////////////////
@@ -0,0 +1,164 @@
+/* General Web framework
+ * tests of handler adapters
+ * Qujie Tech 2019-09-05
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// create instance for tests, it is not bound to a work path
+func newTestInstance() *svrInstance {
+	conf := newFrmConf()
+	discard := &LogInstance{func(level QLogLevel, msg string) {}, func() {}}
+	inst := &svrInstance{
+		nil, "TestService", "", conf, nil,
+		map[string]*LogInstance{"error": discard}, nil,
+		&termHooks{hooks: make(map[uint64]func())}, &cacheRegistry{},
+		nil, false, nil,
+	}
+	return inst
+}
+
+// create handler function of instance with hnd as init handle
+func newTestHandler(hnd QHandle) (*svrInstance, http.HandlerFunc) {
+	inst := newTestInstance()
+	inst.initHandle = QHandle2HandlerFunc(hnd, inst)
+	return inst, inst.initHandle
+}
+
+// session responding fixed text
+type textTestSession struct {
+	text string
+}
+
+// textTestSession: enter
+func (ses *textTestSession) EnterServer() (string, error) {
+	return "", nil
+}
+
+// textTestSession: header
+func (ses *textTestSession) BeginResponse(header http.Header) int {
+	header.Set("Content-Type", "text/plain")
+	return http.StatusOK
+}
+
+// textTestSession: body
+func (ses *textTestSession) WriteResponse(rsp io.Writer) []byte {
+	return []byte(ses.text)
+}
+
+// serve a raw handler and get response
+func serveRawTest(
+	f func(http.ResponseWriter, *http.Request)) *httptest.ResponseRecorder {
+	_, hnd := newTestHandler(HandleFunc2QHandle(f))
+	rec := httptest.NewRecorder()
+	hnd(rec, httptest.NewRequest("GET", "/", nil))
+	return rec
+}
+
+func TestRawDoubleWriteHeader(t *testing.T) {
+	rec := serveRawTest(func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.WriteHeader(http.StatusCreated)
+		rsp.WriteHeader(http.StatusAccepted)
+		io.WriteString(rsp, "created")
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusCreated)
+	}
+	if rec.Body.String() != "created" {
+		t.Fatalf("body %q", rec.Body.String())
+	}
+}
+
+func TestRawNoWrite(t *testing.T) {
+	rec := serveRawTest(func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.Header().Set("X-Test", "1")
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec.Header().Get("X-Test") != "1" || rec.Body.Len() != 0 {
+		t.Fatalf("header %v, body %q", rec.Header(), rec.Body.String())
+	}
+}
+
+func TestRawPanicBeforeWrite(t *testing.T) {
+	rec := serveRawTest(func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.WriteHeader(http.StatusCreated)
+		panic("before write")
+	})
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestRawPanicAfterWrite(t *testing.T) {
+	rec := serveRawTest(func(rsp http.ResponseWriter, req *http.Request) {
+		io.WriteString(rsp, "partial")
+		panic("after write")
+	})
+	// response is committed, so status is kept and body is truncated
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec.Body.String() != "partial" {
+		t.Fatalf("body %q", rec.Body.String())
+	}
+}
+
+func TestRawServer(t *testing.T) {
+	_, hnd := newTestHandler(HandleFunc2QHandle(
+		func(rsp http.ResponseWriter, req *http.Request) {
+			rsp.WriteHeader(http.StatusTeapot)
+			io.WriteString(rsp, strings.Repeat("x", 4096))
+		}))
+	svr := httptest.NewServer(hnd)
+	defer svr.Close()
+	rsp, err := http.Get(svr.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	data, _ := ioutil.ReadAll(rsp.Body)
+	if rsp.StatusCode != http.StatusTeapot || len(data) != 4096 {
+		t.Fatalf("status %d, body length %d", rsp.StatusCode, len(data))
+	}
+}
+
+// benchmark request through raw handle adapter
+func BenchmarkRawHandle(b *testing.B) {
+	_, hnd := newTestHandler(HandleFunc2QHandle(
+		func(rsp http.ResponseWriter, req *http.Request) {
+			rsp.Header().Set("Content-Type", "text/plain")
+			io.WriteString(rsp, "hello")
+		}))
+	req := httptest.NewRequest("GET", "/", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hnd(httptest.NewRecorder(), req)
+	}
+}
+
+// benchmark request through framework session
+func BenchmarkSessionHandle(b *testing.B) {
+	_, hnd := newTestHandler(CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			return &textTestSession{"hello"}
+		}))
+	req := httptest.NewRequest("GET", "/", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hnd(httptest.NewRecorder(), req)
+	}
+}
@@ -7,8 +7,11 @@
 package wframe
 
 import (
+	"fmt"
+	"html/template"
 	"net/http"
 	"os"
+	"sync"
 )
 
 // QInstance defined interface for service master instance
@@ -20,8 +23,9 @@ type QInstance interface {
 	WorkPath(relpath string) string                   // get work path
 	//get log sender
 	Log(name string) func(level QLogLevel, msg string)
-	ServiceName() string // get service name
-	Terminate()          // terminate instance
+	ServiceName() string          // get service name
+	PurgeCache(prefix string) int // purge cached responses by key prefix
+	Terminate()                   // terminate instance
 }
 
 // QEnv is basic environment object interface
@@ -31,16 +35,33 @@ type QEnv interface {
 	Terminate()
 }
 
+// instance which accept callbacks on terminate
+type termRegister interface {
+	onTerminate(f func()) (cancel func())
+}
+
+// callbacks list which called when instance terminate
+type termHooks struct {
+	lock  sync.Mutex
+	seq   uint64
+	hooks map[uint64]func()
+}
+
 // framework instance object, it need implement QInstance interface
 type svrInstance struct {
 	// service init handle
 	initHandle  func(http.ResponseWriter, *http.Request)
-	serviceName string                  // service name identification
-	workPath    string                  // service instance work path
-	conf        *InstConfig             // main configure data
-	env         QEnv                    // service envronment manager
-	logs        map[string]*LogInstance // logger
-	discard     bool                    // a tag mark service discard
+	serviceName string                     // service name identification
+	workPath    string                     // service instance work path
+	conf        *InstConfig                // main configure data
+	env         QEnv                       // service envronment manager
+	logs        map[string]*LogInstance    // logger
+	errPages    map[int]*template.Template // custom error pages
+	term        *termHooks                 // terminate callbacks
+	caches      *cacheRegistry             // response caches
+	access      []*accessLogger            // access loggers
+	discard     bool                       // a tag mark service discard
+	proxies     proxyTrust                 // trusted proxies
 }
 
 // CreateInstance create a basic instance
@@ -54,11 +75,35 @@ func CreateInstance(path string, inithnd QHandle, env QEnv) (
 	if err := loadConf(defaultConfFile, conf); err != nil {
 		return nil, err
 	}
+	errPages, err := loadErrPages(conf.ErrorPages)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range conf.Logs {
+		if err := checkAccessFmt(v.Access); err != nil {
+			return nil, err
+		}
+	}
+	proxies, err := parseTrustedProxies(conf.Proxies)
+	if err != nil {
+		return nil, err
+	}
+	if conf.ProxyHeader, err = checkProxyHeader(conf.ProxyHeader); err != nil {
+		return nil, err
+	}
+	if err := checkCompressConf(conf.Compress); err != nil {
+		return nil, err
+	}
 	servname := conf.ServiceName
 	allLogger := make(map[string]*LogInstance)
+	access := make([]*accessLogger, 0)
 	if conf.Logs != nil {
 		for i, v := range conf.Logs {
 			allLogger[i] = initLog(i, &v)
+			if v.Access != "" {
+				access = append(access,
+					&accessLogger{v.Access, allLogger[i].sender})
+			}
 		}
 	}
 	// make instance object
@@ -69,7 +114,12 @@ func CreateInstance(path string, inithnd QHandle, env QEnv) (
 		conf,
 		nil,
 		allLogger,
+		errPages,
+		&termHooks{hooks: make(map[uint64]func())},
+		&cacheRegistry{},
+		access,
 		false,
+		proxies,
 	}
 	inst.initHandle = QHandle2HandlerFunc(inithnd, inst)
 	if env != nil {
@@ -79,6 +129,36 @@ func CreateInstance(path string, inithnd QHandle, env QEnv) (
 	return inst, nil
 }
 
+// get log sender from instance, it never panic if logger not exists
+func instLogger(inst QInstance, name string) (
+	sndlog func(level QLogLevel, msg string)) {
+	defer (func() {
+		if err := recover(); err != nil {
+			sndlog = func(level QLogLevel, msg string) {}
+		}
+	})()
+	if sndlog = inst.Log(name); sndlog == nil {
+		sndlog = func(level QLogLevel, msg string) {}
+	}
+	return sndlog
+}
+
+// load custom error page templates
+func loadErrPages(pages map[int]string) (map[int]*template.Template, error) {
+	ret := make(map[int]*template.Template)
+	for code, fname := range pages {
+		if code < 400 || code > 599 {
+			return nil, fmt.Errorf("invalid error page status %d", code)
+		}
+		tmpl, err := template.ParseFiles(fname)
+		if err != nil {
+			return nil, err
+		}
+		ret[code] = tmpl
+	}
+	return ret, nil
+}
+
 ////////////////// methods //////////////////
 
 // implement 'Handler': ServeHTTP
@@ -86,6 +166,11 @@ func (s *svrInstance) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
 	s.initHandle(rsp, req)
 }
 
+// serve internal sub-request
+func (s *svrInstance) serveSub(rsp http.ResponseWriter, req *http.Request) {
+	s.initHandle(rsp, req)
+}
+
 // load sub-config file
 func (s *svrInstance) LoadConfig(name string, refobj interface{}) error {
 	if s.conf.Includes == nil {
@@ -147,14 +232,63 @@ func (s *svrInstance) Log(name string) func(level QLogLevel, msg string) {
 	panic("no logger named: " + name)
 }
 
+// write access record to all access loggers
+func (s *svrInstance) accessLog(rec *accessRecord) {
+	for _, lg := range s.access {
+		lg.sender(LQLogINFO, rec.format(lg.format))
+	}
+}
+
+// trusted proxies
+func (s *svrInstance) trustedProxies() proxyTrust {
+	return s.proxies
+}
+
+// get custom error page template
+func (s *svrInstance) errorPage(code int) *template.Template {
+	return s.errPages[code]
+}
+
 // get instance configure
 func (s *svrInstance) InstConf() InstConfig {
 	return *s.conf
 }
 
+// register response cache
+func (s *svrInstance) regCache(cache *rspCache) {
+	s.caches.add(cache)
+}
+
+// purge cached responses of all cache handles by key prefix. it return count
+// of removed responses
+func (s *svrInstance) PurgeCache(prefix string) int {
+	return s.caches.purge(prefix)
+}
+
+// register callback on terminate
+func (s *svrInstance) onTerminate(f func()) (cancel func()) {
+	s.term.lock.Lock()
+	defer s.term.lock.Unlock()
+	s.term.seq++
+	id := s.term.seq
+	s.term.hooks[id] = f
+	return func() {
+		s.term.lock.Lock()
+		defer s.term.lock.Unlock()
+		delete(s.term.hooks, id)
+	}
+}
+
 // terminate service
 func (s *svrInstance) Terminate() {
 	s.discard = true
+	s.term.lock.Lock()
+	hooks := s.term.hooks
+	s.term.hooks = make(map[uint64]func())
+	s.term.lock.Unlock()
+	for _, f := range hooks {
+		f()
+	}
 	for _, v := range s.logs {
 		v.term()
 	}
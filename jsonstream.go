@@ -0,0 +1,126 @@
+/* General Web framework
+ * streaming JSON decoder for request body
+ * Qujie Tech 2019-08-19
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrBodyTooLarge is returned when request body over the limit. it is
+// responded as 413 by framework
+var ErrBodyTooLarge error = &HTTPError{
+	http.StatusRequestEntityTooLarge, "request body too large"}
+
+// JSONStreamOpt defined options of streaming JSON decoder
+type JSONStreamOpt struct {
+	Limit           int64 // max bytes of body, 0 for `LimitPost` of instance
+	DisallowUnknown bool  // error on unknown fields of struct
+	UseNumber       bool  // decode number as json.Number
+}
+
+// JSONStream is a streaming JSON decoder of request body. it embed
+// json.Decoder for token-level reading
+type JSONStream struct {
+	*json.Decoder
+}
+
+// reader which fail with ErrBodyTooLarge when data over the limit
+type bodyLimitReader struct {
+	rd     io.Reader
+	remain int64
+}
+
+//////////////////// bodyLimitReader methods ////////////////////
+
+// bodyLimitReader: read under the limit
+func (lr *bodyLimitReader) Read(p []byte) (int, error) {
+	if lr.remain <= 0 {
+		// probe one byte to detect more data
+		probe := make([]byte, 1)
+		n, err := lr.rd.Read(probe)
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > lr.remain {
+		p = p[:lr.remain]
+	}
+	n, err := lr.rd.Read(p)
+	lr.remain -= int64(n)
+	return n, err
+}
+
+//////////////////// svrRspObj streaming reader ////////////////////
+
+// read body with a streaming JSON decoder, opt can be nil for default options.
+// body is read on demand, so the limit is checked while decoding
+func (srq *svrRspObj) ReadBodyJSONStream(opt *JSONStreamOpt) (
+	*JSONStream, error) {
+	if opt == nil {
+		opt = &JSONStreamOpt{}
+	}
+	if _, err := srq.autoBuffer(); err != nil {
+		return nil, err
+	}
+	var rd io.Reader
+	if srq.mrkReaded && srq.rawContent != nil {
+		rd = bytes.NewReader(srq.rawContent)
+	} else {
+		if err := srq.checkBodyReader(CntReaderJSON); err != nil {
+			return nil, err
+		}
+		srq.mrkReader = CntReaderJSON
+		srq.mrkReaded = true
+		limit := opt.Limit
+		if limit <= 0 {
+			limit = int64(srq.inst.InstConf().LimitPost)
+		}
+		rd = &bodyLimitReader{srq.req.Body, limit}
+	}
+	dec := json.NewDecoder(rd)
+	if opt.DisallowUnknown {
+		dec.DisallowUnknownFields()
+	}
+	if opt.UseNumber {
+		dec.UseNumber()
+	}
+	return &JSONStream{dec}, nil
+}
+
+//////////////////// JSONStream methods ////////////////////
+
+// read a delimiter token
+func (st *JSONStream) expectDelim(delim json.Delim) error {
+	tok, err := st.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expect JSON %q but got %v", delim, tok)
+	}
+	return nil
+}
+
+// EachElem iterate elements of a JSON array at current position. each is
+// called for every element and it should read the element by Decode.
+// iteration stop if each return an error
+func (st *JSONStream) EachElem(each func(index int) error) error {
+	if err := st.expectDelim('['); err != nil {
+		return err
+	}
+	for i := 0; st.More(); i++ {
+		if err := each(i); err != nil {
+			return err
+		}
+	}
+	return st.expectDelim(']')
+}
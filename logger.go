@@ -68,6 +68,7 @@ type frmLogConf struct {
 	MsgFmt     string `yaml:"msg_fmt,omitempty"`
 	QueueSize  uint   `yaml:"queue_size,omitempty"`
 	ReserveDay uint   `yaml:"reserve_day,omitempty"`
+	Access     string `yaml:"access,omitempty"` // access log format
 }
 
 type frmLogger struct {
@@ -135,7 +136,7 @@ func (l *frmLogger) renewlog() error {
 		return err
 	}
 	var logPrefix string
-	if ftype == FTypePipe {
+	if ftype == FTypePipe && l.Access == "" {
 		logPrefix = fmt.Sprintf("%s: ", l.logname)
 	} else {
 		logPrefix = ""
@@ -174,7 +175,11 @@ func loggerProc(logobj *frmLogger, datach chan *frmLogUnit, ctrl chan int) {
 	for {
 		select {
 		case d := <-datach:
-			// write log
+			// write log. access log is written as raw line
+			if logobj.Access != "" {
+				logobj.rawlog.Print(d.msg)
+				continue
+			}
 			timstr := time.Unix(d.ts, 0).Format(logobj.TimeFmt)
 			logobj.rawlog.Printf(logobj.MsgFmt, logLevelMap(d.level), timstr, d.msg)
 		case ctr, ctrOk := <-ctrl:
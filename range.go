@@ -0,0 +1,248 @@
+/* General Web framework
+ * byte range support for sessions
+ * Qujie Tech 2019-08-01
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// max count of ranges in a request
+const maxByteRanges = 64
+
+// QSessionSeeker is optional session interface which expose response content
+// as a ReadSeeker for `Range` requests
+type QSessionSeeker interface {
+	Content() io.ReadSeeker
+}
+
+// QSessionRanged is optional session interface which expose response content
+// as known size and a ranged reader for `Range` requests
+type QSessionRanged interface {
+	ContentSize() int64
+	ReadRange(offset, length int64) (io.ReadCloser, error)
+}
+
+// a satisfiable byte range
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// byte range session decorator
+type rangeSession struct {
+	sesDecorator
+	req      SvrReq
+	ranges   []byteRange // ranges to response, nil for full content
+	size     int64       // content size
+	ctype    string      // content type of full content
+	boundary string      // boundary of multipart/byteranges
+	unsat    bool        // mark range not satisfiable
+}
+
+// CreateRangeSession wrap a session to support `Range` requests. it is
+// applied automatically by framework for sessions implement QSessionSeeker or
+// QSessionRanged. session without these interfaces is returned directly
+func CreateRangeSession(req SvrReq, ses QSession) QSession {
+	if _, ok := ses.(*rangeSession); ok {
+		return ses
+	}
+	_, seeker := ses.(QSessionSeeker)
+	_, ranged := ses.(QSessionRanged)
+	if !seeker && !ranged {
+		return ses
+	}
+	return &rangeSession{sesDecorator: sesDecorator{ses}, req: req}
+}
+
+// parse `Range` header. nil returned for invalid header, empty slice for not
+// satisfiable ranges
+func parseByteRanges(hdr string, size int64) []byteRange {
+	if !strings.HasPrefix(hdr, "bytes=") {
+		return nil
+	}
+	specs := strings.Split(hdr[len("bytes="):], ",")
+	if len(specs) > maxByteRanges {
+		return nil
+	}
+	ret := make([]byteRange, 0, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		sep := strings.Index(spec, "-")
+		if sep < 0 {
+			return nil
+		}
+		first, last := spec[:sep], spec[sep+1:]
+		if first == "" { // suffix range
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			ret = append(ret, byteRange{size - n, n})
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil ||
+				end < start {
+				return nil
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			continue
+		}
+		ret = append(ret, byteRange{start, end - start + 1})
+	}
+	return ret
+}
+
+// check `If-Range` precondition by response validators
+func checkIfRange(req SvrReq, header http.Header) bool {
+	ir := strings.TrimSpace(req.Header().Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, "\"") || strings.HasPrefix(ir, "W/") {
+		etag := header.Get("ETag")
+		return etag != "" && matchETag(ir, etag, false)
+	}
+	lastmod := header.Get("Last-Modified")
+	return lastmod != "" && lastmod == ir
+}
+
+//////////////////// byteRange methods ////////////////////
+
+// Content-Range value of range
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+//////////////////// rangeSession methods ////////////////////
+
+// rangeSession: size of content
+func (ses *rangeSession) contentSize() (int64, error) {
+	if ranged, ok := ses.QSession.(QSessionRanged); ok {
+		return ranged.ContentSize(), nil
+	}
+	rs := ses.QSession.(QSessionSeeker).Content()
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = rs.Seek(0, io.SeekStart)
+	return size, err
+}
+
+// rangeSession: copy a range of content
+func (ses *rangeSession) copyRange(rsp io.Writer, r byteRange) error {
+	if ranged, ok := ses.QSession.(QSessionRanged); ok {
+		rd, err := ranged.ReadRange(r.start, r.length)
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+		_, err = io.CopyN(rsp, rd, r.length)
+		return err
+	}
+	rs := ses.QSession.(QSessionSeeker).Content()
+	if _, err := rs.Seek(r.start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(rsp, rs, r.length)
+	return err
+}
+
+// rangeSession: evaluate `Range` request
+func (ses *rangeSession) BeginResponse(header http.Header) (status int) {
+	status = ses.QSession.BeginResponse(header)
+	if status != http.StatusOK {
+		return status
+	}
+	header.Set("Accept-Ranges", "bytes")
+	rhdr := ses.req.Header().Get("Range")
+	if rhdr == "" || ses.req.Method() != MethodGET ||
+		!checkIfRange(ses.req, header) {
+		return status
+	}
+	size, err := ses.contentSize()
+	if err != nil {
+		return status
+	}
+	ranges := parseByteRanges(rhdr, size)
+	if ranges == nil {
+		return status
+	}
+	ses.size = size
+	header.Del("Content-Length")
+	if len(ranges) == 0 {
+		ses.unsat = true
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return http.StatusRequestedRangeNotSatisfiable
+	}
+	ses.ranges = ranges
+	if len(ranges) == 1 {
+		header.Set("Content-Range", ranges[0].contentRange(size))
+		header.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		return http.StatusPartialContent
+	}
+	rnd := make([]byte, 16)
+	rand.Read(rnd)
+	ses.boundary = hex.EncodeToString(rnd)
+	ses.ctype = header.Get("Content-Type")
+	header.Set("Content-Type", "multipart/byteranges; boundary="+ses.boundary)
+	return http.StatusPartialContent
+}
+
+// rangeSession: write ranges of content
+func (ses *rangeSession) WriteResponse(rsp io.Writer) []byte {
+	if ses.unsat {
+		return nil
+	}
+	if ses.ranges == nil {
+		return ses.QSession.WriteResponse(rsp)
+	}
+	if len(ses.ranges) == 1 {
+		ses.copyRange(rsp, ses.ranges[0])
+		return nil
+	}
+	for _, r := range ses.ranges {
+		part := textproto.MIMEHeader{}
+		if ses.ctype != "" {
+			part.Set("Content-Type", ses.ctype)
+		}
+		part.Set("Content-Range", r.contentRange(ses.size))
+		fmt.Fprintf(rsp, "\r\n--%s\r\n", ses.boundary)
+		for k, v := range part {
+			fmt.Fprintf(rsp, "%s: %s\r\n", k, v[0])
+		}
+		io.WriteString(rsp, "\r\n")
+		if err := ses.copyRange(rsp, r); err != nil {
+			return nil
+		}
+	}
+	fmt.Fprintf(rsp, "\r\n--%s--\r\n", ses.boundary)
+	return nil
+}
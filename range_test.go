@@ -0,0 +1,111 @@
+/* General Web framework
+ * tests of byte range support
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// session of seekable content
+type seekerTestSession struct {
+	textTestSession
+}
+
+// seekerTestSession: content
+func (ses *seekerTestSession) Content() io.ReadSeeker {
+	return strings.NewReader(ses.text)
+}
+
+// seekerTestSession: header with validator
+func (ses *seekerTestSession) BeginResponse(header http.Header) int {
+	header.Set("ETag", "\"v1\"")
+	return ses.textTestSession.BeginResponse(header)
+}
+
+func TestParseByteRanges(t *testing.T) {
+	for _, c := range []struct {
+		hdr  string
+		size int64
+		want []byteRange
+	}{
+		{"bytes=0-4", 10, []byteRange{{0, 5}}},
+		{"bytes=5-", 10, []byteRange{{5, 5}}},
+		{"bytes=-3", 10, []byteRange{{7, 3}}},
+		{"bytes=-20", 10, []byteRange{{0, 10}}},
+		{"bytes=8-20", 10, []byteRange{{8, 2}}},
+		{"bytes=0-1, 4-5", 10, []byteRange{{0, 2}, {4, 2}}},
+		{"bytes=10-", 10, []byteRange{}},
+		{"bytes=-0", 10, []byteRange{}},
+		{"bytes=20-30, 5-6", 10, []byteRange{{5, 2}}},
+		{"items=0-1", 10, nil},
+		{"bytes=5-1", 10, nil},
+		{"bytes=a-b", 10, nil},
+		{"bytes=1", 10, nil},
+		{"bytes=" + strings.Repeat("0-0,", maxByteRanges) + "0-0", 10, nil},
+	} {
+		got := parseByteRanges(c.hdr, c.size)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %v, want %v", c.hdr, got, c.want)
+		}
+	}
+}
+
+func TestRangeSession(t *testing.T) {
+	_, hnd := newTestHandler(CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			return &seekerTestSession{textTestSession{"0123456789"}}
+		}))
+	rec := serveTest(hnd, "GET", "/", http.Header{"Range": {"bytes=2-4"}})
+	if rec.Code != http.StatusPartialContent ||
+		rec.Header().Get("Content-Range") != "bytes 2-4/10" ||
+		rec.Body.String() != "234" {
+		t.Fatalf("status %d, %v, body %q", rec.Code, rec.Header(), rec.Body)
+	}
+	rec = serveTest(hnd, "GET", "/", http.Header{"Range": {"bytes=10-"}})
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable ||
+		rec.Header().Get("Content-Range") != "bytes */10" ||
+		rec.Body.Len() != 0 {
+		t.Fatalf("status %d, %v, body %q", rec.Code, rec.Header(), rec.Body)
+	}
+	rec = serveTest(hnd, "GET", "/", http.Header{
+		"Range": {"bytes=0-1"}, "If-Range": {"\"v0\""}})
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+		t.Fatalf("If-Range mismatch: status %d", rec.Code)
+	}
+	rec = serveTest(hnd, "GET", "/", http.Header{"Range": {"bytes=0-1,-2"}})
+	media, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if rec.Code != http.StatusPartialContent || err != nil ||
+		media != "multipart/byteranges" {
+		t.Fatalf("status %d, Content-Type %q", rec.Code,
+			rec.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	for _, want := range []struct{ crange, body string }{
+		{"bytes 0-1/10", "01"}, {"bytes 8-9/10", "89"},
+	} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(part)
+		if part.Header.Get("Content-Range") != want.crange ||
+			part.Header.Get("Content-Type") != "text/plain" ||
+			string(data) != want.body {
+			t.Fatalf("part %v, body %q", part.Header, data)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("end of parts: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+/* General Web framework
+ * in-memory response recorder
+ * Qujie Tech 2019-08-05
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// recorded complete response
+type recordRsp struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// ResponseWriter which record response in memory
+type rspRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+// session decorator which record response of inner session in EnterServer
+type captureSession struct {
+	sesDecorator
+	req    SvrReq
+	rec    *rspRecorder
+	result *recordRsp
+	done   func(rsp *recordRsp) // callback when response recorded
+}
+
+// session which replay a recorded response
+type replaySession struct {
+	rsp   *recordRsp
+	extra http.Header // extra headers append to response
+}
+
+// create response recorder
+func newRspRecorder() *rspRecorder {
+	return &rspRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+// capture response of session created by hnd. raw handle output is recorded
+// too. done is called after response recorded, nil for none
+func beginCapture(hnd QHandle, req SvrReq, env interface{},
+	done func(rsp *recordRsp)) QSession {
+	rec := newRspRecorder()
+	ses := hnd.BeginSession(&rspOverrideReq{req, rec}, env)
+	if ses == nil {
+		return nil
+	}
+	return &captureSession{sesDecorator{ses}, req, rec, nil, done}
+}
+
+// run a complete session life of hnd with env and record it response. inner
+// redirect is not followed
+func runCaptured(hnd QHandle, req SvrReq, env interface{}) (
+	rsp *recordRsp, err error) {
+	ses := beginCapture(hnd, req, env, func(r *recordRsp) {
+		rsp = r
+	})
+	if ses == nil {
+		return nil, errors.New("except session")
+	}
+	defer (func() {
+		if perr := recover(); perr != nil {
+			err = panicErr(perr)
+		}
+		if ex, ok := ses.(QSessionEx); ok {
+			ex.Terminate()
+		}
+	})()
+	rdir, err := ses.EnterServer()
+	if err != nil {
+		return nil, err
+	}
+	if rdir != "" {
+		return nil, errors.New("inner redirect is not supported")
+	}
+	return rsp, nil
+}
+
+// make a copy of header
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = append([]string(nil), v...)
+	}
+}
+
+//////////////////// rspRecorder methods ////////////////////
+
+// rspRecorder: ResponseWriter.Header
+func (rec *rspRecorder) Header() http.Header {
+	return rec.header
+}
+
+// rspRecorder: ResponseWriter.WriteHeader
+func (rec *rspRecorder) WriteHeader(statusCode int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = statusCode
+}
+
+// rspRecorder: ResponseWriter.Write
+func (rec *rspRecorder) Write(data []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.body.Write(data)
+}
+
+// rspRecorder: recorded features, nothing supported
+func (rec *rspRecorder) rspFeatures() (flush, hijack, push bool) {
+	return false, false, false
+}
+
+// rspRecorder: make recorded response
+func (rec *rspRecorder) result() *recordRsp {
+	header := make(http.Header)
+	copyHeader(header, rec.header)
+	return &recordRsp{rec.status, header, rec.body.Bytes()}
+}
+
+//////////////////// captureSession methods ////////////////////
+
+// captureSession: enter inner session and record response
+func (ses *captureSession) EnterServer() (redirect string, err error) {
+	if redirect, err = ses.QSession.EnterServer(); redirect != "" ||
+		err != nil {
+		return
+	}
+	if !ses.rec.wroteHeader {
+		ses.sesDecorator.bindRequest(ses.req)
+		status := ses.QSession.BeginResponse(ses.rec.header)
+		ses.rec.WriteHeader(status)
+		if ret := ses.QSession.WriteResponse(ses.rec); ret != nil {
+			ses.rec.Write(ret)
+		}
+	}
+	ses.result = ses.rec.result()
+	if ses.done != nil {
+		ses.done(ses.result)
+	}
+	return "", nil
+}
+
+// captureSession: replay recorded header
+func (ses *captureSession) BeginResponse(header http.Header) (status int) {
+	copyHeader(header, ses.result.header)
+	return ses.result.status
+}
+
+// captureSession: replay recorded body
+func (ses *captureSession) WriteResponse(rsp io.Writer) []byte {
+	return ses.result.body
+}
+
+// captureSession: request is bound before record
+func (ses *captureSession) bindRequest(req SvrReq) {
+}
+
+//////////////////// replaySession methods ////////////////////
+
+// replaySession: nothing to do
+func (ses *replaySession) EnterServer() (redirect string, err error) {
+	return "", nil
+}
+
+// replaySession: replay recorded header
+func (ses *replaySession) BeginResponse(header http.Header) (status int) {
+	copyHeader(header, ses.rsp.header)
+	copyHeader(header, ses.extra)
+	return ses.rsp.status
+}
+
+// replaySession: replay recorded body
+func (ses *replaySession) WriteResponse(rsp io.Writer) []byte {
+	return ses.rsp.body
+}
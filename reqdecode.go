@@ -0,0 +1,88 @@
+/* General Web framework
+ * request body decompression by Content-Encoding
+ * Qujie Tech 2019-08-30
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// decompressed request body, it close the raw body
+type decodedBody struct {
+	io.Reader
+	raw io.Closer
+}
+
+// open decoder of a content coding
+func openBodyDecoder(coding string, rd io.Reader) (io.Reader, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(rd)
+	case "deflate":
+		// `deflate` should be zlib format, but some clients send raw deflate
+		brd := bufio.NewReader(rd)
+		hdr, err := brd.Peek(2)
+		if err != nil {
+			return nil, err
+		}
+		if hdr[0]&0x0f == 8 && (uint(hdr[0])<<8|uint(hdr[1]))%31 == 0 {
+			return zlib.NewReader(brd)
+		}
+		return flate.NewReader(brd), nil
+	}
+	return nil, &HTTPError{http.StatusUnsupportedMediaType,
+		"unsupported content encoding " + coding}
+}
+
+//////////////////// decodedBody methods ////////////////////
+
+// decodedBody: close raw body
+func (body *decodedBody) Close() error {
+	return body.raw.Close()
+}
+
+//////////////////// svrRspObj body decoding ////////////////////
+
+// replace body with decompressed reader by `Content-Encoding`. codings are
+// decoded in reverse order of header. decoded body is of unknown length and
+// limited by `LimitPost`, so size after decompression is checked
+func (srq *svrRspObj) decodeBody() error {
+	hdr := srq.req.Header.Get("Content-Encoding")
+	if hdr == "" || srq.req.Body == nil || srq.req.Body == http.NoBody {
+		return nil
+	}
+	codings := strings.Split(hdr, ",")
+	var rd io.Reader = srq.req.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+		dec, err := openBodyDecoder(coding, rd)
+		if err != nil {
+			if _, ok := err.(*HTTPError); !ok {
+				err = &HTTPError{http.StatusBadRequest,
+					"invalid " + coding + " content"}
+			}
+			return err
+		}
+		rd = dec
+	}
+	srq.req.Body = &decodedBody{
+		&bodyLimitReader{rd, int64(srq.inst.InstConf().LimitPost)},
+		srq.req.Body,
+	}
+	srq.req.ContentLength = -1
+	srq.req.Header.Del("Content-Encoding")
+	srq.req.Header.Del("Content-Length")
+	return nil
+}
@@ -0,0 +1,117 @@
+/* General Web framework
+ * tests of request body decompression
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// create request object with encoded body
+func newDecodeTestReq(body []byte, coding string, limit uint) SvrReq {
+	srq := newBodyTestReq(bytes.NewReader(body), "application/json", limit)
+	srq.Header().Set("Content-Encoding", coding)
+	return srq
+}
+
+// compress data with a content coding
+func encodeTestBody(coding string, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	var wr io.WriteCloser
+	switch coding {
+	case "gzip":
+		wr = gzip.NewWriter(buf)
+	case "deflate":
+		wr = zlib.NewWriter(buf)
+	case "raw":
+		wr, _ = flate.NewWriter(buf, flate.DefaultCompression)
+	}
+	wr.Write(data)
+	wr.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	data := []byte(`{"name":"bob"}`)
+	for _, c := range []struct {
+		coding, header string
+	}{
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"raw", "deflate"},
+	} {
+		srq := newDecodeTestReq(encodeTestBody(c.coding, data), c.header, 1024)
+		var v map[string]string
+		if err := srq.ReadBodyJSON(&v); err != nil || v["name"] != "bob" {
+			t.Fatalf("%s: %v, %v", c.coding, v, err)
+		}
+	}
+	// stacked codings are decoded in reverse order
+	srq := newDecodeTestReq(
+		encodeTestBody("deflate", encodeTestBody("gzip", data)),
+		"gzip, deflate", 1024)
+	if err := srq.BufferBody(); err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]string
+	if err := srq.ReadBodyJSON(&v); err != nil || v["name"] != "bob" {
+		t.Fatalf("stacked: %v, %v", v, err)
+	}
+}
+
+func TestDecodeBodyError(t *testing.T) {
+	for _, c := range []struct {
+		coding string
+		body   []byte
+		status int
+	}{
+		{"br", []byte("x"), http.StatusUnsupportedMediaType},
+		{"gzip", []byte("not gzip content"), http.StatusBadRequest},
+	} {
+		srq := newDecodeTestReq(c.body, c.coding, 1024)
+		err := srq.BufferBody()
+		if herr, ok := err.(*HTTPError); !ok || herr.StatusCode() != c.status {
+			t.Fatalf("%s: %v", c.coding, err)
+		}
+	}
+}
+
+func TestDecodeBodyBomb(t *testing.T) {
+	// 4MB of zeros is compressed to a few KB, far below `LimitPost`
+	bomb := encodeTestBody("gzip", make([]byte, 4<<20))
+	if len(bomb) >= 64<<10 {
+		t.Fatalf("bomb size %d", len(bomb))
+	}
+	srq := newDecodeTestReq(bomb, "gzip", 64<<10)
+	if err := srq.BufferBody(); err != ErrBodyTooLarge {
+		t.Fatalf("buffer: %v", err)
+	}
+	checkBodyReadErr(t, srq, ErrBodyTooLarge)
+	// stream reader is limited too
+	srq = newDecodeTestReq(bomb, "gzip", 64<<10)
+	var total int
+	var err error
+	buf := make([]byte, 4096)
+	for err == nil {
+		var n int
+		n, err = srq.ReadBodyRaw(buf)
+		total += n
+	}
+	if err != ErrBodyTooLarge || total > 64<<10 {
+		t.Fatalf("stream read %d, %v", total, err)
+	}
+	srq = newDecodeTestReq(bomb, "gzip", 64<<10)
+	srq.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := srq.ReadBodyForm(); err != ErrBodyTooLarge {
+		t.Fatalf("form: %v", err)
+	}
+}
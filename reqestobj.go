@@ -7,6 +7,8 @@
 package wframe
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +18,7 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -35,28 +38,46 @@ const (
 	CntReaderJSON
 	CntReaderForm
 	CntReaderExtern
+	CntReaderCodec
 )
 
 // SvrReq defined server request object
 type SvrReq interface {
 	//environment
-	RemoteAddr() string          // client address
+	frmInst() QInstance          // framework instance
+	RemoteAddr() string          // socket peer address
+	ClientIP() string            // client IP through trusted proxies
+	Scheme() string              // public scheme through trusted proxies
+	RequestID() string           // unique ID of request
 	RawReq() *http.Request       // raw Request object
 	rawRsp() http.ResponseWriter // raw ResponseWrite obejct
+	// get log sender which tag messages with request ID
+	Log(name string) func(level QLogLevel, msg string)
 	// URL
-	RawURL() string               // URL string
-	RawQuery() string             // query string
-	Method() string               // request method
-	Fragment() string             // URL fragment
-	HostName() string             // request hostname
-	FullPath() string             // full path after hostname
-	RelPath() string              // relative path in current gateway
-	BasePath() string             // base path about current gateway
-	GetPath(rel bool) []string    // get splited path
-	trimPath(path []string) error // move relative path
-	redirect(path []string)       // set path for redirect
-	isRedir() bool                // check request been redirected
-	Query() url.Values            // parse query parameter
+	RawURL() string                 // URL string
+	RawQuery() string               // query string
+	Method() string                 // request method
+	Fragment() string               // URL fragment
+	HostName() string               // hostname through trusted proxies
+	FullPath() string               // full path after hostname
+	RelPath() string                // relative path in current gateway
+	BasePath() string               // base path about current gateway
+	GetPath(rel bool) []string      // get splited path
+	trimPath(path []string) error   // move relative path
+	redirect(target, method string) // set target for redirect
+	isRedir() bool                  // check request been redirected
+	RedirectTrace() []string        // inner redirect chain
+	Query() url.Values              // parse query parameter
+	PathParam(name string) string   // path parameter matched by route
+	setPathParam(name, val string)  // set path parameter
+	// copy of request state with another raw request and response writer
+	cloneReq(rsp http.ResponseWriter, req *http.Request) SvrReq
+	// request-scoped values, they are kept across inner redirect
+	Value(key string) interface{}
+	SetValue(key string, val interface{})
+	// internal sub-request against route tree of instance
+	SubRequest(ctx context.Context, method, target string,
+		header http.Header, body io.Reader) (*SubResponse, error)
 	// cookies reader
 	Cookie(name string) (*http.Cookie, error) // get Cookie by cookie name
 	Cookies() []*http.Cookie                  // Cookies list
@@ -66,28 +87,53 @@ type SvrReq interface {
 	// Rewrite request headers
 	RewriteHeader(name string, values []string) error
 	// body reader
+	BufferBody() error                    // capture body for repeated reading
 	ReadBodyRaw(buff []byte) (int, error) //get body as bytes buffer
 	ReadBodyJSON(ref interface{}) error   // get body as a JSON object
 	ReadBodyForm() (url.Values, error)    // get body as URI form
+	ReadBody(ref interface{}) error       // get body by codec of Content-Type
+	// get body as a streaming JSON decoder
+	ReadBodyJSONStream(opt *JSONStreamOpt) (*JSONStream, error)
 	// Multi-part body
 	ReadBodyMtPart(boundary string) *multipart.Reader
+	// multipart upload with files spooled to disk
+	ReadUpload(conf *UploadConf) (*Upload, error)
+	// bind request data to struct by field tags
+	Bind(dst interface{}) error
 	// To string
 	String() string
+	debugInfo() map[string]interface{} // request report for debug output
 }
 
 // response object
 type svrRspObj struct {
-	inst       QInstance           // framework instance
-	req        *http.Request       // raw-request
-	mrkReaded  bool                // mark body content already readed
-	mrkReader  ContentReaderType   // mark readr alreay exists
-	rawReadlen uint                // read body raw data length
-	rawContent []byte              // raw data for native struct reader
-	rsp        http.ResponseWriter // raw-response
-	fullpath   []string            // full require path
-	relpath    []string            // relative path
-	postform   url.Values          // form data from POST content
-	redir      bool                // mark gateway been redirected
+	inst       QInstance              // framework instance
+	req        *http.Request          // raw-request
+	mrkReaded  bool                   // mark body content already readed
+	mrkReader  ContentReaderType      // mark readr alreay exists
+	rawReadlen uint                   // read body raw data length
+	rawContent []byte                 // raw data for native struct reader
+	rsp        http.ResponseWriter    // raw-response
+	fullpath   []string               // full require path
+	relpath    []string               // relative path
+	postform   url.Values             // form data from POST content
+	redir      bool                   // mark gateway been redirected
+	values     map[string]interface{} // request-scoped values
+	trace      []string               // inner redirect chain
+	reqid      string                 // request ID
+	params     map[string]string      // path parameters
+	releases   []func()               // release callbacks of session
+	buffered   bool                   // body captured in rawContent
+	rawPos     int                    // raw reading position of buffered body
+	fwd        *forwardInfo           // client info through trusted proxies
+	upload     *Upload                // parsed multipart upload
+	readErr    error                  // error of reading body
+}
+
+// request decorator which replace raw ResponseWriter for wrapped handles
+type rspOverrideReq struct {
+	SvrReq
+	rsp http.ResponseWriter
 }
 
 // splite path string to a slice
@@ -112,10 +158,83 @@ func splitePath(pathstr string) []string {
 	return outSp
 }
 
+// a media range or coding with it quality value in accept headers
+type qValue struct {
+	value string
+	q     float64
+}
+
+// parse accept style header (`Accept`, `Accept-Encoding`...) to value list
+func parseQList(hdr string) []qValue {
+	ret := make([]qValue, 0, 4)
+	for _, part := range strings.Split(hdr, ",") {
+		fields := strings.Split(part, ";")
+		val := strings.ToLower(strings.TrimSpace(fields[0]))
+		if val == "" {
+			continue
+		}
+		qv := qValue{val, 1}
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || strings.ToLower(kv[0]) != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+				qv.q = q
+			}
+		}
+		ret = append(ret, qv)
+	}
+	return ret
+}
+
+// choose the best media type from offers by `Accept` header. the first offer
+// is preferred if client accept anything or header is empty
+func negotiateType(accept string, offers []string) string {
+	if len(offers) < 1 {
+		return ""
+	}
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	accepts := parseQList(accept)
+	best, bestq := "", 0.0
+	for _, offer := range offers {
+		// find most specific media range for offer
+		q, spec := 0.0, -1
+		for _, acc := range accepts {
+			var s int
+			switch {
+			case acc.value == offer:
+				s = 2
+			case strings.HasSuffix(acc.value, "/*") &&
+				strings.HasPrefix(offer, acc.value[:len(acc.value)-1]):
+				s = 1
+			case acc.value == "*/*" || acc.value == "*":
+				s = 0
+			default:
+				continue
+			}
+			if s > spec {
+				q, spec = acc.q, s
+			}
+		}
+		if q > bestq {
+			best, bestq = offer, q
+		}
+	}
+	return best
+}
+
 // create response object
 func createReqObj(
 	inst QInstance, rsp http.ResponseWriter, req *http.Request) SvrReq {
-	readed := !(req.ContentLength > 0)
+	// body of unknown length (-1) is available for read
+	readed := req.ContentLength == 0 || req.Body == nil || req.Body == http.NoBody
+	conf := inst.InstConf()
+	reqid := requestID(&conf.RequestID, req)
+	// sub-request is internal, it can access inner path as redirected
+	subreq := subReqDepth(req.Context()) > 0
 	// path splite
 	var relpath []string
 	fullpath := splitePath(req.URL.Path)
@@ -129,13 +248,36 @@ func createReqObj(
 	return &svrRspObj{
 		inst, req, readed, CntReaderNone,
 		0, nil, rsp, fullpath,
-		relpath, nil, false,
+		relpath, nil, subreq,
+		nil, nil, reqid, nil,
+		nil, false, 0, requestForward(inst, req), nil, nil,
 	}
 }
 
 ////////////////////// method //////////////////////
 
-// client address
+// replaced raw ResponseWrite obejct
+func (orq *rspOverrideReq) rawRsp() http.ResponseWriter {
+	return orq.rsp
+}
+
+// framework instance
+func (srq *svrRspObj) frmInst() QInstance {
+	return srq.inst
+}
+
+// unique ID of request
+func (srq *svrRspObj) RequestID() string {
+	return srq.reqid
+}
+
+// get log sender of instance which tag messages with request ID. it never
+// panic if logger not exists
+func (srq *svrRspObj) Log(name string) func(level QLogLevel, msg string) {
+	return reqIDLogger(instLogger(srq.inst, name), srq.reqid)
+}
+
+// socket peer address, it is the proxy if request is forwarded
 func (srq *svrRspObj) RemoteAddr() string {
 	return srq.req.RemoteAddr
 }
@@ -170,9 +312,10 @@ func (srq *svrRspObj) Fragment() string {
 	return srq.req.URL.Fragment
 }
 
-// request hostname
+// request hostname, `Host` header of raw request is replaced by trusted
+// proxies
 func (srq *svrRspObj) HostName() string {
-	return srq.req.Host
+	return srq.fwd.host
 }
 
 // parse query parameter
@@ -209,8 +352,11 @@ func (srq *svrRspObj) RewriteHeader(name string, values []string) error {
 	return nil
 }
 
-// check body reader
+// check body reader. error of previous reading is returned again
 func (srq *svrRspObj) checkBodyReader(readtype ContentReaderType) error {
+	if srq.readErr != nil {
+		return srq.readErr
+	}
 	if srq.mrkReaded {
 		return errors.New("No content")
 	}
@@ -219,15 +365,37 @@ func (srq *svrRspObj) checkBodyReader(readtype ContentReaderType) error {
 			return errors.New("Another reader already exists")
 		}
 	}
-	return nil
+	return srq.decodeBody()
 }
 
-// raw reader for native structure
+// body limit for native reader
+func (srq *svrRspObj) nativeBodyLimit() int64 {
+	limit := int64(srq.inst.InstConf().LimitPost)
+	if limit > int64(ContentReadHardLimit) {
+		limit = int64(ContentReadHardLimit)
+	}
+	return limit
+}
+
+// raw reader for native structure. partial content is dropped if failed, and
+// the error is kept for later readers
 func (srq *svrRspObj) nativeBodyRawReader() error {
+	if err := srq.readBodyContent(); err != nil {
+		srq.readErr, srq.rawContent = err, nil
+		return err
+	}
+	return nil
+}
+
+// read whole body to rawContent
+func (srq *svrRspObj) readBodyContent() error {
 	totalLen := srq.ContentLength()
-	if totalLen > int64(ContentReadHardLimit) ||
-		totalLen > int64(srq.inst.InstConf().LimitPost) {
-		return errors.New("out of limited content length for parse")
+	limit := srq.nativeBodyLimit()
+	if totalLen > limit {
+		return ErrBodyTooLarge
+	}
+	if totalLen < 0 {
+		return srq.unknownBodyRawReader(limit)
 	}
 	if srq.rawContent == nil {
 		srq.rawContent = make([]byte, totalLen)
@@ -250,24 +418,116 @@ func (srq *svrRspObj) nativeBodyRawReader() error {
 	return nil
 }
 
-// read raw body data
+// raw reader for body of unknown length, buffer grow up to limit
+func (srq *svrRspObj) unknownBodyRawReader(limit int64) error {
+	buf := bytes.NewBuffer(srq.rawContent)
+	_, err := buf.ReadFrom(
+		&bodyLimitReader{srq.req.Body, limit - int64(buf.Len())})
+	srq.rawContent = buf.Bytes()
+	srq.rawReadlen = uint(len(srq.rawContent))
+	return err
+}
+
+// capture body in memory, then every reader can read it repeatedly, also
+// after inner redirect. body is limited by `LimitPost` and
+// `ContentReadHardLimit`. it fail if body already consumed by a stream reader
+func (srq *svrRspObj) BufferBody() error {
+	if srq.buffered {
+		return nil
+	}
+	if srq.readErr != nil {
+		return srq.readErr
+	}
+	if srq.mrkReaded {
+		// body read by native reader is complete already
+		if srq.rawContent == nil {
+			if srq.mrkReader != CntReaderNone {
+				return errors.New("Body already consumed")
+			}
+			srq.rawContent = []byte{} // no content
+		}
+		srq.buffered = true
+		return nil
+	}
+	if err := srq.checkBodyReader(CntReaderRAW); err != nil {
+		return err
+	}
+	if srq.mrkReader != CntReaderNone {
+		return errors.New("Body already consumed")
+	}
+	srq.mrkReader = CntReaderRAW
+	srq.mrkReaded = true
+	if err := srq.nativeBodyRawReader(); err != nil {
+		return err
+	}
+	if srq.rawContent == nil {
+		srq.rawContent = []byte{}
+	}
+	srq.buffered = true
+	return nil
+}
+
+// buffer body before first reader if `BufferBody` is enabled in config
+func (srq *svrRspObj) autoBuffer() (bool, error) {
+	if !srq.buffered && srq.mrkReader == CntReaderNone &&
+		srq.inst.InstConf().BufferBody {
+		if err := srq.BufferBody(); err != nil {
+			return false, err
+		}
+	}
+	return srq.buffered, nil
+}
+
+// raw reading of buffered body, it rewind after EOF
+func (srq *svrRspObj) readBuffered(buff []byte) (int, error) {
+	rlen := copy(buff, srq.rawContent[srq.rawPos:])
+	srq.rawPos += rlen
+	if srq.rawPos >= len(srq.rawContent) {
+		srq.rawPos = 0
+		return rlen, io.EOF
+	}
+	return rlen, nil
+}
+
+// read raw body data. body of unknown length is limited by `LimitPost`
 func (srq *svrRspObj) ReadBodyRaw(buff []byte) (int, error) {
+	buffered, err := srq.autoBuffer()
+	if err != nil {
+		return 0, err
+	}
+	if buffered {
+		return srq.readBuffered(buff)
+	}
 	if err := srq.checkBodyReader(CntReaderRAW); err != nil {
 		return 0, err
 	}
 	srq.mrkReader = CntReaderRAW
-	rlen, err := srq.req.Body.Read(buff)
+	var rd io.Reader = srq.req.Body
+	if srq.ContentLength() < 0 {
+		rd = &bodyLimitReader{rd,
+			int64(srq.inst.InstConf().LimitPost) - int64(srq.rawReadlen)}
+	}
+	rlen, err := rd.Read(buff)
 	if rlen > 0 {
 		srq.rawReadlen += uint(rlen)
-		if int64(rlen) >= srq.ContentLength() {
+		if srq.ContentLength() >= 0 &&
+			int64(srq.rawReadlen) >= srq.ContentLength() {
 			srq.mrkReaded = true
 		}
 	}
+	if err == io.EOF {
+		srq.mrkReaded = true
+	} else if err != nil {
+		srq.readErr = err
+	}
 	return rlen, err
 }
 
 // read body as JSON object
 func (srq *svrRspObj) ReadBodyJSON(ref interface{}) error {
+	if _, err := srq.autoBuffer(); err != nil {
+		return err
+	}
 	if srq.mrkReaded && srq.rawContent != nil {
 		return json.Unmarshal(srq.rawContent, ref)
 	}
@@ -287,13 +547,19 @@ func (srq *svrRspObj) ReadBodyForm() (url.Values, error) {
 	if srq.postform != nil {
 		return srq.postform, nil
 	}
-	if err := srq.checkBodyReader(CntReaderForm); err != nil {
+	buffered, err := srq.autoBuffer()
+	if err != nil {
 		return nil, err
 	}
-	srq.mrkReader = CntReaderForm
-	srq.mrkReaded = true
-	if err := srq.nativeBodyRawReader(); err != nil {
-		return nil, err
+	if !buffered {
+		if err := srq.checkBodyReader(CntReaderForm); err != nil {
+			return nil, err
+		}
+		srq.mrkReader = CntReaderForm
+		srq.mrkReaded = true
+		if err := srq.nativeBodyRawReader(); err != nil {
+			return nil, err
+		}
 	}
 	val, err := url.ParseQuery(string(srq.rawContent))
 	if err != nil {
@@ -305,6 +571,11 @@ func (srq *svrRspObj) ReadBodyForm() (url.Values, error) {
 
 // read body as multipart reference RFC 2046
 func (srq *svrRspObj) ReadBodyMtPart(boundary string) *multipart.Reader {
+	if buffered, err := srq.autoBuffer(); err != nil {
+		return nil
+	} else if buffered {
+		return multipart.NewReader(bytes.NewReader(srq.rawContent), boundary)
+	}
 	if err := srq.checkBodyReader(CntReaderExtern); err != nil {
 		return nil
 	}
@@ -376,14 +647,64 @@ func (srq *svrRspObj) GetPath(rel bool) []string {
 	return path
 }
 
-// set path for redirect
-func (srq *svrRspObj) redirect(path []string) {
+// copy of request state for a detached session, for example background cache
+// refresh. path, path parameters and values are copied, body is not available
+func (srq *svrRspObj) cloneReq(
+	rsp http.ResponseWriter, req *http.Request) SvrReq {
+	clone := *srq
+	clone.req, clone.rsp = req, rsp
+	clone.mrkReaded, clone.mrkReader = true, CntReaderNone
+	clone.rawReadlen, clone.rawContent, clone.rawPos = 0, nil, 0
+	clone.postform, clone.buffered, clone.releases = nil, false, nil
+	clone.upload, clone.readErr = nil, nil
+	clone.fullpath = srq.GetPath(false)
+	clone.relpath = srq.GetPath(true)
+	clone.trace = srq.RedirectTrace()
+	if srq.params != nil {
+		clone.params = make(map[string]string, len(srq.params))
+		for k, v := range srq.params {
+			clone.params[k] = v
+		}
+	}
+	if srq.values != nil {
+		clone.values = make(map[string]interface{}, len(srq.values))
+		for k, v := range srq.values {
+			clone.values[k] = v
+		}
+	}
+	return &clone
+}
+
+// set target for redirect. target is a path with optional query string, the
+// query is kept if target not contain '?'. method is kept if it is empty
+func (srq *svrRspObj) redirect(target, method string) {
+	if srq.trace == nil {
+		srq.trace = []string{srq.Method() + " " + srq.req.URL.RequestURI()}
+	}
+	pathstr := target
+	if qpos := strings.Index(target, "?"); qpos >= 0 {
+		pathstr = target[:qpos]
+		srq.req.URL.RawQuery = target[qpos+1:]
+	}
+	path := splitePath(pathstr)
 	srq.fullpath = make([]string, len(path))
 	srq.relpath = make([]string, len(path))
 	srq.redir = true
+	srq.params = nil
+	srq.rawPos = 0
 	copy(srq.fullpath, path)
 	copy(srq.relpath, path)
 	srq.req.URL.Path = "/" + strings.Join(path, "/")
+	if method = strings.ToUpper(method); method != "" &&
+		method != srq.req.Method {
+		srq.req.Method = method
+		// body is not available for method without content
+		if (method == MethodGET || method == MethodHEAD) &&
+			srq.rawContent == nil {
+			srq.mrkReaded = true
+		}
+	}
+	srq.trace = append(srq.trace, srq.Method()+" "+srq.req.URL.RequestURI())
 }
 
 // check redirect
@@ -391,6 +712,64 @@ func (srq *svrRspObj) isRedir() bool {
 	return srq.redir
 }
 
+// inner redirect chain, include original request. nil if not redirected
+func (srq *svrRspObj) RedirectTrace() []string {
+	if srq.trace == nil {
+		return nil
+	}
+	trace := make([]string, len(srq.trace))
+	copy(trace, srq.trace)
+	return trace
+}
+
+// get path parameter matched by route, empty if not exists
+func (srq *svrRspObj) PathParam(name string) string {
+	return srq.params[name]
+}
+
+// set path parameter
+func (srq *svrRspObj) setPathParam(name, val string) {
+	if srq.params == nil {
+		srq.params = make(map[string]string)
+	}
+	srq.params[name] = val
+}
+
+// get request-scoped value
+func (srq *svrRspObj) Value(key string) interface{} {
+	return srq.values[key]
+}
+
+// set request-scoped value
+func (srq *svrRspObj) SetValue(key string, val interface{}) {
+	if srq.values == nil {
+		srq.values = make(map[string]interface{})
+	}
+	srq.values[key] = val
+}
+
+// request report as structured data
+func (srq *svrRspObj) debugInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"request_id":    srq.RequestID(),
+		"raw_url":       srq.RawURL(),
+		"raw_query":     srq.RawQuery(),
+		"method":        srq.Method(),
+		"client_ip":     srq.ClientIP(),
+		"scheme":        srq.Scheme(),
+		"hostname":      srq.HostName(),
+		"full_path":     srq.FullPath(),
+		"relative_path": srq.RelPath(),
+		"base_path":     srq.BasePath(),
+		"is_redirect":   srq.isRedir(),
+		"redir_trace":   srq.RedirectTrace(),
+		"content_len":   srq.ContentLength(),
+		"query":         srq.Query(),
+		"path_params":   srq.params,
+		"header":        srq.Header(),
+	}
+}
+
 // convert to string report
 func (srq *svrRspObj) String() string {
 	// escape string list
@@ -473,10 +852,13 @@ func (srq *svrRspObj) String() string {
 		"<thead><tr><th style=\"width:180px;\">Field</th>" +
 		"<th style=\"width:350px\">Value</th></tr></thead>" +
 		"<tbody>" +
+		"<tr><td>request id</td><td>%s</td></tr>" +
 		"<tr><td>raw url</td><td>%s</td></tr>" +
 		"<tr><td>raw query string</td><td>%s</td></tr>" +
 		"<tr><td>method</td><td>%s</td></tr>" +
 		"<tr><td>fragment</td><td>%s</td></tr>" +
+		"<tr><td>client ip</td><td>%s</td></tr>" +
+		"<tr><td>scheme</td><td>%s</td></tr>" +
 		"<tr><td>hostname</td><td>%s</td></tr>" +
 		"<tr><td>full path</td><td>%s</td></tr>" +
 		"<tr><td>relative path</td><td>%s</td></tr>" +
@@ -484,17 +866,22 @@ func (srq *svrRspObj) String() string {
 		"<tr><td>sp. full path</td><td>%q</td></tr>" +
 		"<tr><td>sp. relative path</td><td>%q</td></tr>" +
 		"<tr><td>is redirect</td><td>%t</td></tr>" +
+		"<tr><td>redirect trace</td><td>%s</td></tr>" +
 		"<tr><td>content length</td><td>%d</td></tr>" +
 		"</tbody>" +
 		"</table>" + querystr() + cookiestr() + headerstr()
 
 	return fmt.Sprintf(
-		temp, html.EscapeString(srq.RawURL()),
+		temp, html.EscapeString(srq.RequestID()), html.EscapeString(srq.RawURL()),
 		html.EscapeString(srq.RawQuery()), srq.Method(),
-		html.EscapeString(srq.Fragment()), srq.HostName(),
+		html.EscapeString(srq.Fragment()), html.EscapeString(srq.ClientIP()),
+		srq.Scheme(), html.EscapeString(srq.HostName()),
 		html.EscapeString(srq.FullPath()), html.EscapeString(srq.RelPath()),
 		html.EscapeString(srq.BasePath()), mapescape(srq.GetPath(false), nil),
 		mapescape(srq.GetPath(true), nil), srq.isRedir(),
+		strings.Join(mapescape(srq.RedirectTrace(), func(s string) string {
+			return fmt.Sprintf("<div>%s</div>", s)
+		}), ""),
 		srq.ContentLength(),
 	)
 }
@@ -0,0 +1,89 @@
+/* General Web framework
+ * tests of request object
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// reader which fail after data
+type failTestReader struct {
+	rd  io.Reader
+	err error
+}
+
+// failTestReader: read
+func (r *failTestReader) Read(buf []byte) (int, error) {
+	n, err := r.rd.Read(buf)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+// create request object of body with limit of POST
+func newBodyTestReq(body io.Reader, ctype string, limit uint) SvrReq {
+	inst := newTestInstance()
+	inst.conf.LimitPost = limit
+	req := httptest.NewRequest("POST", "/", ioutil.NopCloser(body))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", ctype)
+	return createReqObj(inst, httptest.NewRecorder(), req)
+}
+
+// check every body reader return err
+func checkBodyReadErr(t *testing.T, req SvrReq, err error) {
+	var v map[string]interface{}
+	if e := req.BufferBody(); e != err {
+		t.Errorf("BufferBody: %v", e)
+	}
+	if e := req.ReadBodyJSON(&v); e != err {
+		t.Errorf("ReadBodyJSON: %v", e)
+	}
+	if e := req.ReadBody(&v); e != err &&
+		req.Header().Get("Content-Type") == "application/json" {
+		t.Errorf("ReadBody: %v", e)
+	}
+	if _, e := req.ReadBodyForm(); e != err {
+		t.Errorf("ReadBodyForm: %v", e)
+	}
+	if _, e := req.ReadBodyRaw(make([]byte, 16)); e != err {
+		t.Errorf("ReadBodyRaw: %v", e)
+	}
+}
+
+func TestBodyTooLargeKept(t *testing.T) {
+	body := "a=1&b=" + strings.Repeat("x", 64) + "&c=3"
+	req := newBodyTestReq(strings.NewReader(body),
+		"application/x-www-form-urlencoded", 32)
+	if _, err := req.ReadBodyForm(); err != ErrBodyTooLarge {
+		t.Fatalf("first read: %v", err)
+	}
+	checkBodyReadErr(t, req, ErrBodyTooLarge)
+	req = newBodyTestReq(strings.NewReader(`{"a":"`+strings.Repeat("x", 64)+`"}`),
+		"application/json", 32)
+	if err := req.BufferBody(); err != ErrBodyTooLarge {
+		t.Fatalf("first buffer: %v", err)
+	}
+	checkBodyReadErr(t, req, ErrBodyTooLarge)
+}
+
+func TestBodyReadErrorKept(t *testing.T) {
+	readErr := errors.New("connection reset")
+	req := newBodyTestReq(&failTestReader{strings.NewReader(`{"a":1`), readErr},
+		"application/json", 1024)
+	var v map[string]interface{}
+	if err := req.ReadBodyJSON(&v); err != readErr {
+		t.Fatalf("first read: %v", err)
+	}
+	checkBodyReadErr(t, req, readErr)
+}
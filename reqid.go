@@ -0,0 +1,73 @@
+/* General Web framework
+ * request ID generation and propagation
+ * Qujie Tech 2019-08-14
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// default header of request ID
+const defaultReqIDHeader = "X-Request-ID"
+
+// max length of request ID accepted from client
+const maxReqIDLength = 128
+
+// valid request ID from client
+var matchReqID = regexp.MustCompile("^[a-zA-Z0-9._:/+=-]+$")
+
+// W3C trace context `traceparent` header
+var matchTraceParent = regexp.MustCompile(
+	"^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$")
+
+// context key of parent request ID for sub-request
+type reqIDKey struct{}
+
+// generate a new request ID
+func newRequestID() string {
+	rnd := make([]byte, 16)
+	rand.Read(rnd)
+	return hex.EncodeToString(rnd)
+}
+
+// header name of request ID
+func reqIDHeader(conf *RequestIDConf) string {
+	if conf.Header == "" {
+		return defaultReqIDHeader
+	}
+	return conf.Header
+}
+
+// get request ID from parent request, trusted headers or generate a new one
+func requestID(conf *RequestIDConf, req *http.Request) string {
+	if id, ok := req.Context().Value(reqIDKey{}).(string); ok && id != "" {
+		return id
+	}
+	if conf.Trust {
+		id := strings.TrimSpace(req.Header.Get(reqIDHeader(conf)))
+		if id != "" && len(id) <= maxReqIDLength && matchReqID.MatchString(id) {
+			return id
+		}
+		tp := matchTraceParent.FindStringSubmatch(
+			strings.TrimSpace(req.Header.Get("Traceparent")))
+		if tp != nil && tp[1] != strings.Repeat("0", 32) {
+			return tp[1]
+		}
+	}
+	return newRequestID()
+}
+
+// make log sender which tag messages with request ID
+func reqIDLogger(sndlog func(level QLogLevel, msg string),
+	id string) func(level QLogLevel, msg string) {
+	return func(level QLogLevel, msg string) {
+		sndlog(level, "[req:"+id+"] "+msg)
+	}
+}
@@ -219,11 +219,34 @@ func (rhnd *frmRtePath) setRoot(hnd QHandle) {
 	}
 }
 
-// found node from path tree
-func (rhnd *frmRtePath) findPath(
-	pattern []string, newpath bool) (interface{}, bool, []string) {
+// find path parameter node (':name') in a level of path tree
+func pathParamNode(pathstep map[string]interface{}) (string, interface{}) {
+	for k, v := range pathstep {
+		if k[0:1] == ":" {
+			return k[1:], v
+		}
+	}
+	return "", nil
+}
+
+// only one path parameter is allowed in a level of path tree
+func checkPathParam(pathstep map[string]interface{}, l string) {
+	if l[0:1] != ":" {
+		return
+	}
+	if name, node := pathParamNode(pathstep); node != nil && name != l[1:] {
+		panic(fmt.Sprintf(
+			"failed add handle to path. conflict path parameter :%s", name))
+	}
+}
+
+// found node from path tree. segment of path parameter is matched when no
+// constant segment matched, and it value is returned in params
+func (rhnd *frmRtePath) findPath(pattern []string, newpath bool) (
+	node interface{}, inner bool, stack []string, params map[string]string) {
 	if pattern == nil || len(pattern) < 1 {
-		return rhnd.getRoot()
+		node, inner, stack = rhnd.getRoot()
+		return
 	}
 	innerPath := false
 	pathstep := rhnd.allpath
@@ -236,12 +259,22 @@ func (rhnd *frmRtePath) findPath(
 			innerPath = true
 		}
 		nextstep, ok := pathstep[l]
+		if !ok && !newpath {
+			if pname, pnode := pathParamNode(pathstep); pnode != nil {
+				if params == nil {
+					params = make(map[string]string)
+				}
+				params[pname] = l
+				nextstep, ok = pnode, true
+			}
+		}
 		if !ok {
 			if newpath {
+				checkPathParam(pathstep, l)
 				nextstep = make(map[string]interface{})
 				pathstep[l] = interface{}(nextstep)
 			} else {
-				return pathstep, innerPath, pathstack
+				return pathstep, innerPath, pathstack, params
 			}
 		}
 		pathstack = append(pathstack, l)
@@ -250,17 +283,17 @@ func (rhnd *frmRtePath) findPath(
 			pathstep = nextstep.(map[string]interface{})
 		case QHandle:
 			expHnd := nextstep.(QHandle)
-			return expHnd, innerPath, pathstack
+			return expHnd, innerPath, pathstack, params
 		default:
-			return nil, false, nil
+			return nil, false, nil, nil
 		}
 	}
-	return pathstep, innerPath, pathstack
+	return pathstep, innerPath, pathstack, params
 }
 
 // check path available
 func (rhnd *frmRtePath) checkPath(pattern []string) bool {
-	hnd, _, _ := rhnd.findPath(pattern, false)
+	hnd, _, _, _ := rhnd.findPath(pattern, false)
 	switch hnd.(type) {
 	case map[string]interface{}:
 		return true
@@ -271,14 +304,14 @@ func (rhnd *frmRtePath) checkPath(pattern []string) bool {
 
 // find QHandle from path
 func (rhnd *frmRtePath) findHandle(
-	pattern []string) (QHandle, bool, []string) {
-	hnd, inner, step := rhnd.findPath(pattern, false)
+	pattern []string) (QHandle, bool, []string, map[string]string) {
+	hnd, inner, step, params := rhnd.findPath(pattern, false)
 	switch hnd.(type) {
 	case QHandle:
 		expHnd := hnd.(QHandle)
-		return expHnd, inner, step
+		return expHnd, inner, step, params
 	default:
-		return nil, false, nil
+		return nil, false, nil, nil
 	}
 }
 
@@ -292,7 +325,7 @@ func (rhnd *frmRtePath) insertHandle(pattern []string, handler QHandle) {
 		return
 	}
 	if len(pattern) > 1 {
-		hnd, _, _ := rhnd.findPath(pattern[:len(pattern)-1], true)
+		hnd, _, _, _ := rhnd.findPath(pattern[:len(pattern)-1], true)
 		if hnd == nil {
 			panic("failed add handle to path. specify locate not available")
 		}
@@ -304,8 +337,10 @@ func (rhnd *frmRtePath) insertHandle(pattern []string, handler QHandle) {
 		if ok {
 			panic("failed add handle to path. sepcify locate already exists")
 		}
+		checkPathParam(pmap, pattern[len(pattern)-1])
 		pmap[pattern[len(pattern)-1]] = interface{}(handler)
 	} else {
+		checkPathParam(rhnd.allpath, pattern[0])
 		rhnd.allpath[pattern[0]] = interface{}(handler)
 	}
 	// combine all route path
@@ -332,7 +367,7 @@ func (rhnd *frmRtePath) Handle(pattern string, handler QHandle) {
 
 // implement BeginSession in QHandle
 func (rhnd *frmRtePath) BeginSession(req SvrReq, env interface{}) QSession {
-	hnd, inner, step := rhnd.findHandle(req.GetPath(true))
+	hnd, inner, step, params := rhnd.findHandle(req.GetPath(true))
 	dbgmsg := rhnd.DebugMsg(func() string { return req.String() })
 	if hnd == nil {
 		if rhnd.rootnode != nil {
@@ -345,6 +380,9 @@ func (rhnd *frmRtePath) BeginSession(req SvrReq, env interface{}) QSession {
 			http.StatusForbidden, "Unavailable this locate", dbgmsg())
 	}
 	req.trimPath(step)
+	for k, v := range params {
+		req.setPathParam(k, v)
+	}
 	return hnd.BeginSession(req, env)
 }
 
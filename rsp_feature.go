@@ -0,0 +1,166 @@
+/* General Web framework
+ * optional ResponseWriter features passthrough
+ * Qujie Tech 2019-07-15
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// ResponseWriter which report optional features of the underlying writer
+type rspFeature interface {
+	rspFeatures() (flush, hijack, push bool)
+}
+
+// raw handle adapter features
+type rawFlusher struct{ adp *rawRspAdaper }
+type rawHijacker struct{ adp *rawRspAdaper }
+type rawPusher struct{ adp *rawRspAdaper }
+
+// check optional features of a ResponseWriter
+func rspFeatures(rsp http.ResponseWriter) (flush, hijack, push bool) {
+	if feat, ok := rsp.(rspFeature); ok {
+		return feat.rspFeatures()
+	}
+	_, flush = rsp.(http.Flusher)
+	_, hijack = rsp.(http.Hijacker)
+	_, push = rsp.(http.Pusher)
+	return
+}
+
+// expose raw adapter with features which underlying writer supported
+func wrapRawAdapter(adp *rawRspAdaper) http.ResponseWriter {
+	fl, hj, ps := rspFeatures(adp.rawrsp)
+	switch {
+	case fl && hj && ps:
+		return struct {
+			*rawRspAdaper
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{adp, rawFlusher{adp}, rawHijacker{adp}, rawPusher{adp}}
+	case fl && hj:
+		return struct {
+			*rawRspAdaper
+			http.Flusher
+			http.Hijacker
+		}{adp, rawFlusher{adp}, rawHijacker{adp}}
+	case fl && ps:
+		return struct {
+			*rawRspAdaper
+			http.Flusher
+			http.Pusher
+		}{adp, rawFlusher{adp}, rawPusher{adp}}
+	case hj && ps:
+		return struct {
+			*rawRspAdaper
+			http.Hijacker
+			http.Pusher
+		}{adp, rawHijacker{adp}, rawPusher{adp}}
+	case fl:
+		return struct {
+			*rawRspAdaper
+			http.Flusher
+		}{adp, rawFlusher{adp}}
+	case hj:
+		return struct {
+			*rawRspAdaper
+			http.Hijacker
+		}{adp, rawHijacker{adp}}
+	case ps:
+		return struct {
+			*rawRspAdaper
+			http.Pusher
+		}{adp, rawPusher{adp}}
+	default:
+		return adp
+	}
+}
+
+//////////////////// raw adapter features ////////////////////
+
+// rawFlusher: commit header and flush
+func (f rawFlusher) Flush() {
+	if f.adp.hijacked {
+		return
+	}
+	f.adp.wroteHeader = true
+	f.adp.commit()
+	if fl, ok := f.adp.rawrsp.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// rawHijacker: take over connection. framework will not write response
+func (h rawHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.adp.rawrsp.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		h.adp.hijacked = true
+		h.adp.wroteHeader = true
+		h.adp.committed = true
+		h.adp.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// rawPusher: HTTP/2 server push
+func (p rawPusher) Push(target string, opts *http.PushOptions) error {
+	ps, ok := p.adp.rawrsp.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return ps.Push(target, opts)
+}
+
+//////////////////// frmRspWriter features ////////////////////
+
+// frmRspWriter: features of underlying writer
+func (w *frmRspWriter) rspFeatures() (flush, hijack, push bool) {
+	return rspFeatures(w.rsp)
+}
+
+// frmRspWriter: http.Flusher. header is written before flush
+func (w *frmRspWriter) Flush() {
+	if w.hijacked {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if fl, ok := w.rsp.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// frmRspWriter: http.Hijacker. response is finished after hijacked
+func (w *frmRspWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.rsp.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		w.hijacked = true
+		w.wroteHeader = true
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// frmRspWriter: http.Pusher
+func (w *frmRspWriter) Push(target string, opts *http.PushOptions) error {
+	ps, ok := w.rsp.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return ps.Push(target, opts)
+}
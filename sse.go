@@ -0,0 +1,137 @@
+/* General Web framework
+ * Server-Sent Events session
+ * Qujie Tech 2019-07-22
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// default interval of keepalive comment
+const sseDefaultKeepalive = 15 * time.Second
+
+// SSEvent is a event sent by Server-Sent Events session
+type SSEvent struct {
+	ID    string        // event id, empty for none
+	Event string        // event type, empty for default "message"
+	Data  string        // event data, multiline supported
+	Retry time.Duration // reconnection time, 0 for none
+}
+
+// Server-Sent Events session, it implement QSession
+type sseSession struct {
+	req       SvrReq
+	source    func(ctx context.Context, lastID string) <-chan *SSEvent
+	events    <-chan *SSEvent
+	keepalive time.Duration
+	cancel    context.CancelFunc // stop event source
+}
+
+// CreateSSESession create a Server-Sent Events session. source is called
+// with `Last-Event-ID` of request (empty for new stream) and the events is
+// streamed until channel closed or client disconnected. ctx is cancelled when
+// stream finished, producer must stop sending and exit when ctx is done,
+// otherwise it block forever. keepalive is interval of comment line, 0 for
+// default interval
+func CreateSSESession(req SvrReq,
+	source func(ctx context.Context, lastID string) <-chan *SSEvent,
+	keepalive time.Duration) QSession {
+	if keepalive <= 0 {
+		keepalive = sseDefaultKeepalive
+	}
+	return &sseSession{req, source, nil, keepalive, nil}
+}
+
+// encode event to stream format
+func (ev *SSEvent) encode() []byte {
+	buf := &strings.Builder{}
+	if ev.ID != "" {
+		fmt.Fprintf(buf, "id: %s\n", sseLine(ev.ID))
+	}
+	if ev.Event != "" {
+		fmt.Fprintf(buf, "event: %s\n", sseLine(ev.Event))
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(buf, "retry: %d\n", ev.Retry/time.Millisecond)
+	}
+	data := strings.Replace(ev.Data, "\r\n", "\n", -1)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	return []byte(buf.String())
+}
+
+// remove line break from single line field
+func sseLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+//////////////////// sseSession methods ////////////////////
+
+// sseSession: open event source from last event id
+func (ses *sseSession) EnterServer() (redirect string, err error) {
+	var ctx context.Context
+	ctx, ses.cancel = context.WithCancel(ses.req.RawReq().Context())
+	ses.events = ses.source(
+		ctx, strings.TrimSpace(ses.req.Header().Get("Last-Event-ID")))
+	return "", nil
+}
+
+// sseSession: stop event source if stream is not finished
+func (ses *sseSession) Terminate() {
+	if ses.cancel != nil {
+		ses.cancel()
+	}
+}
+
+// sseSession: event stream headers
+func (ses *sseSession) BeginResponse(header http.Header) (status int) {
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	return http.StatusOK
+}
+
+// sseSession: stream events
+func (ses *sseSession) WriteResponse(rsp io.Writer) []byte {
+	defer ses.Terminate()
+	flush := func() {}
+	if fl, ok := rsp.(http.Flusher); ok {
+		flush = fl.Flush
+	}
+	flush()
+	done := ses.req.RawReq().Context().Done()
+	ticker := time.NewTicker(ses.keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-ses.events:
+			if !ok {
+				return nil
+			}
+			if ev == nil {
+				continue
+			}
+			if _, err := rsp.Write(ev.encode()); err != nil {
+				return nil
+			}
+			flush()
+		case <-ticker.C:
+			if _, err := io.WriteString(rsp, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+			flush()
+		case <-done:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/* General Web framework
+ * internal sub-request and aggregation
+ * Qujie Tech 2019-08-12
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// max nested depth of sub-request
+const maxSubRequestDepth = 8
+
+// request headers which are not inherited by sub-request
+var subReqDropHeaders = []string{
+	"Accept-Encoding", "Range", "If-Range", "If-Match", "If-None-Match",
+	"If-Modified-Since", "If-Unmodified-Since", "Content-Length",
+	"Content-Type", "Content-Encoding", "Transfer-Encoding",
+}
+
+// context key of sub-request depth
+type subReqDepthKey struct{}
+
+// instance which serve sub-request with it route tree
+type subRequester interface {
+	serveSub(rsp http.ResponseWriter, req *http.Request)
+}
+
+// SubResponse is response of an internal sub-request
+type SubResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// AggregateItem defined a sub-request of aggregate handle
+type AggregateItem struct {
+	Name    string        // key in merged result
+	Method  string        // request method, default GET
+	Target  string        // path with optional query string
+	Timeout time.Duration // timeout of the sub-request, 0 for handle timeout
+}
+
+// aggregate handle, it implement QHandle
+type aggregateHandle struct {
+	items   []AggregateItem
+	timeout time.Duration
+}
+
+// aggregate session
+type aggregateSession struct {
+	hnd    *aggregateHandle
+	req    SvrReq
+	data   map[string]json.RawMessage
+	errs   map[string]*aggregateErr
+	status int
+}
+
+// failed sub-request in aggregate result
+type aggregateErr struct {
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error"`
+}
+
+// get sub-request depth from context
+func subReqDepth(ctx context.Context) int {
+	if depth, ok := ctx.Value(subReqDepthKey{}).(int); ok {
+		return depth
+	}
+	return 0
+}
+
+// CreateAggregateHandle create a handle which run internal sub-requests
+// concurrently and merge JSON results to one response as
+// `{"data": {name: result}, "errors": {name: {status, error}}}`.
+// timeout is default timeout for each sub-request, 0 for no timeout
+func CreateAggregateHandle(
+	items []AggregateItem, timeout time.Duration) QHandle {
+	return &aggregateHandle{items, timeout}
+}
+
+//////////////////// svrRspObj sub-request ////////////////////
+
+// run sub-request against route tree of instance. headers of current request
+// are inherited except conditional, range and content headers, and values in
+// header override them. inner paths ('@') are accessible
+func (srq *svrRspObj) SubRequest(ctx context.Context, method, target string,
+	header http.Header, body io.Reader) (*SubResponse, error) {
+	sub, ok := srq.inst.(subRequester)
+	if !ok {
+		return nil, errors.New("instance not support sub-request")
+	}
+	depth := subReqDepth(srq.req.Context()) + 1
+	if depth > maxSubRequestDepth {
+		return nil, errors.New("over limited sub-request depth")
+	}
+	if method == "" {
+		method = MethodGET
+	}
+	if !strings.HasPrefix(target, "/") {
+		target = "/" + target
+	}
+	subctx := context.WithValue(ctx, subReqDepthKey{}, depth)
+	subctx = context.WithValue(subctx, reqIDKey{}, srq.reqid)
+	subctx = context.WithValue(subctx, forwardKey{}, srq.fwd)
+	rawreq, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	rawreq = rawreq.WithContext(subctx)
+	rawreq.Host = srq.req.Host
+	rawreq.RemoteAddr = srq.req.RemoteAddr
+	rawreq.Proto, rawreq.ProtoMajor, rawreq.ProtoMinor =
+		srq.req.Proto, srq.req.ProtoMajor, srq.req.ProtoMinor
+	copyHeader(rawreq.Header, srq.req.Header)
+	for _, name := range subReqDropHeaders {
+		rawreq.Header.Del(name)
+	}
+	for k, v := range header {
+		rawreq.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+	}
+	// run sub-request and wait it or context done
+	rec := newRspRecorder()
+	done := make(chan bool)
+	go (func() {
+		defer close(done)
+		sub.serveSub(rec, rawreq)
+	})()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	rsp := rec.result()
+	return &SubResponse{rsp.status, rsp.header, rsp.body}, nil
+}
+
+//////////////////// aggregateHandle methods ////////////////////
+
+// aggregateHandle: init
+func (hnd *aggregateHandle) InitHandler(
+	inst QInstance, rte RouteHandle, ptree *RouteTree) {
+	return
+}
+
+// aggregateHandle: create session
+func (hnd *aggregateHandle) BeginSession(
+	req SvrReq, env interface{}) QSession {
+	return &aggregateSession{hnd, req, nil, nil, http.StatusOK}
+}
+
+//////////////////// aggregateSession methods ////////////////////
+
+// aggregateSession: run a sub-request
+func (ses *aggregateSession) runItem(item AggregateItem) (
+	json.RawMessage, *aggregateErr) {
+	ctx := ses.req.RawReq().Context()
+	timeout := item.Timeout
+	if timeout <= 0 {
+		timeout = ses.hnd.timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	rsp, err := ses.req.SubRequest(ctx, item.Method, item.Target, nil, nil)
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			return nil, &aggregateErr{http.StatusGatewayTimeout, "timeout"}
+		}
+		return nil, &aggregateErr{0, err.Error()}
+	}
+	if rsp.Status < 200 || rsp.Status > 299 {
+		return nil, &aggregateErr{rsp.Status, errStatusTitle(rsp.Status)}
+	}
+	if !json.Valid(rsp.Body) {
+		return nil, &aggregateErr{rsp.Status, "invalid JSON result"}
+	}
+	return json.RawMessage(rsp.Body), nil
+}
+
+// aggregateSession: run all sub-requests concurrently
+func (ses *aggregateSession) EnterServer() (redirect string, err error) {
+	ses.data = make(map[string]json.RawMessage)
+	ses.errs = make(map[string]*aggregateErr)
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, item := range ses.hnd.items {
+		wg.Add(1)
+		go (func(item AggregateItem) {
+			defer wg.Done()
+			var ret json.RawMessage
+			var rerr *aggregateErr
+			func() {
+				defer (func() {
+					if perr := recover(); perr != nil {
+						rerr = &aggregateErr{0, fmt.Sprintf("%q", perr)}
+					}
+				})()
+				ret, rerr = ses.runItem(item)
+			}()
+			lock.Lock()
+			defer lock.Unlock()
+			if rerr != nil {
+				ses.errs[item.Name] = rerr
+			} else {
+				ses.data[item.Name] = ret
+			}
+		})(item)
+	}
+	wg.Wait()
+	if len(ses.data) == 0 && len(ses.errs) > 0 {
+		ses.status = http.StatusBadGateway
+	}
+	return "", nil
+}
+
+// aggregateSession: JSON response
+func (ses *aggregateSession) BeginResponse(header http.Header) (status int) {
+	header.Set("Content-Type", "application/json;charset=utf-8")
+	return ses.status
+}
+
+// aggregateSession: merged result
+func (ses *aggregateSession) WriteResponse(rsp io.Writer) []byte {
+	ret, err := json.Marshal(map[string]interface{}{
+		"data":   ses.data,
+		"errors": ses.errs,
+	})
+	if err != nil {
+		return []byte("{}")
+	}
+	return ret
+}
@@ -0,0 +1,234 @@
+/* General Web framework
+ * multipart upload with disk spooling
+ * Qujie Tech 2019-08-28
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// default limits of upload
+const (
+	uploadDefaultParts = 100
+	uploadDefaultDir   = "upload_tmp"
+)
+
+// UploadConf defined limits of multipart upload, zero value for default
+type UploadConf struct {
+	MaxFileSize  int64  // max size of a file, default `LimitPost`
+	MaxTotalSize int64  // max size of all parts, default `LimitPost`
+	MaxParts     int    // max count of parts, default 100
+	TempDir      string // spool directory relative to work path
+}
+
+// UploadFile is a file in multipart upload, it is spooled to a temp file
+// which is removed when session finished
+type UploadFile struct {
+	Field    string               // form field name
+	FileName string               // file name from client
+	Header   textproto.MIMEHeader // part header
+	Size     int64                // file size
+	path     string               // temp file path
+}
+
+// Upload is result of multipart upload
+type Upload struct {
+	Values url.Values               // form fields
+	Files  map[string][]*UploadFile // files by field name
+}
+
+// request which release resources when session finished
+type reqReleaser interface {
+	release()
+}
+
+// remove spooled files
+func removeUploadFiles(files map[string][]*UploadFile) {
+	for _, list := range files {
+		for _, f := range list {
+			os.Remove(f.path)
+		}
+	}
+}
+
+//////////////////// UploadFile methods ////////////////////
+
+// Open spooled file for read
+func (f *UploadFile) Open() (*os.File, error) {
+	return os.Open(f.path)
+}
+
+// TempPath get path of spooled file. it is removed when session finished, so
+// move or copy it to keep the file
+func (f *UploadFile) TempPath() string {
+	return f.path
+}
+
+//////////////////// svrRspObj upload ////////////////////
+
+// directory of spooled files
+func (srq *svrRspObj) uploadDir(conf *UploadConf) (string, error) {
+	rel := conf.TempDir
+	if rel == "" {
+		rel = uploadDefaultDir
+	}
+	dir := srq.inst.WorkPath(rel)
+	if dir == "" {
+		return "", nil // system temp directory
+	}
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// spool a file part to temp file, limit is max size of the file
+func (srq *svrRspObj) spoolPart(dir string, part io.Reader, limit int64) (
+	string, int64, error) {
+	fp, err := ioutil.TempFile(dir, "upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(fp, io.LimitReader(part, limit+1))
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size > limit {
+		err = &HTTPError{
+			http.StatusRequestEntityTooLarge, "upload file too large"}
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", 0, err
+	}
+	return fp.Name(), size, nil
+}
+
+// read multipart upload, boundary is taken from `Content-Type`. files are
+// spooled to temp files under work path and removed when session finished.
+// conf can be nil for default limits, over limit is responded as 413 by
+// framework. upload is parsed once, later calls (for example after Bind)
+// return the same result and conf is ignored
+func (srq *svrRspObj) ReadUpload(conf *UploadConf) (*Upload, error) {
+	if srq.upload != nil {
+		return srq.upload, nil
+	}
+	if conf == nil {
+		conf = &UploadConf{}
+	}
+	limitPost := int64(srq.inst.InstConf().LimitPost)
+	maxFile, maxTotal, maxParts :=
+		conf.MaxFileSize, conf.MaxTotalSize, conf.MaxParts
+	if maxFile <= 0 {
+		maxFile = limitPost
+	}
+	if maxTotal <= 0 {
+		maxTotal = limitPost
+	}
+	if maxParts <= 0 {
+		maxParts = uploadDefaultParts
+	}
+	media, params, err := mime.ParseMediaType(srq.Header().Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(media, "multipart/") ||
+		params["boundary"] == "" {
+		return nil, &HTTPError{http.StatusUnsupportedMediaType,
+			"upload must be multipart with boundary"}
+	}
+	dir, err := srq.uploadDir(conf)
+	if err != nil {
+		return nil, err
+	}
+	buffered, err := srq.autoBuffer()
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader = srq.req.Body
+	if buffered {
+		body = bytes.NewReader(srq.rawContent)
+	} else {
+		if err := srq.checkBodyReader(CntReaderExtern); err != nil {
+			if err == srq.readErr {
+				return nil, err
+			}
+			return nil, &HTTPError{http.StatusBadRequest,
+				"upload body is not available: " + err.Error()}
+		}
+		srq.mrkReader = CntReaderExtern
+		srq.mrkReaded = true
+	}
+	rd := &bodyLimitReader{body, maxTotal}
+	mpart := multipart.NewReader(rd, params["boundary"])
+	upload := &Upload{make(url.Values), make(map[string][]*UploadFile)}
+	fail := func(err error) (*Upload, error) {
+		removeUploadFiles(upload.Files)
+		var sterr statusCoder
+		if !errors.As(err, &sterr) {
+			err = &HTTPError{http.StatusBadRequest, err.Error()}
+		}
+		if !buffered {
+			srq.readErr = err // stream is consumed partially
+		}
+		return nil, err
+	}
+	for count := 0; ; count++ {
+		part, err := mpart.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if count >= maxParts {
+			part.Close()
+			return fail(&HTTPError{http.StatusRequestEntityTooLarge,
+				"too many upload parts"})
+		}
+		if part.FormName() == "" {
+			part.Close()
+			continue
+		}
+		if part.FileName() == "" {
+			data, err := ioutil.ReadAll(part)
+			part.Close()
+			if err != nil {
+				return fail(err)
+			}
+			upload.Values.Add(part.FormName(), string(data))
+			continue
+		}
+		path, size, err := srq.spoolPart(dir, part, maxFile)
+		part.Close()
+		if err != nil {
+			return fail(err)
+		}
+		upload.Files[part.FormName()] = append(upload.Files[part.FormName()],
+			&UploadFile{part.FormName(), part.FileName(), part.Header, size, path})
+	}
+	srq.onRelease(func() { removeUploadFiles(upload.Files) })
+	srq.upload = upload
+	return upload, nil
+}
+
+// register callback when session finished
+func (srq *svrRspObj) onRelease(f func()) {
+	srq.releases = append(srq.releases, f)
+}
+
+// release resources of request
+func (srq *svrRspObj) release() {
+	releases := srq.releases
+	srq.releases = nil
+	for _, f := range releases {
+		f()
+	}
+}
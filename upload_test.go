@@ -0,0 +1,158 @@
+/* General Web framework
+ * tests of multipart upload
+ * Qujie Tech 2019-09-06
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a part of upload test
+type uploadTestPart struct {
+	field, file, data string
+}
+
+// create request object of multipart upload, files are spooled under dir
+func newUploadTestReq(dir string, parts []uploadTestPart) SvrReq {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for _, p := range parts {
+		if p.file == "" {
+			mw.WriteField(p.field, p.data)
+			continue
+		}
+		fw, _ := mw.CreateFormFile(p.field, p.file)
+		fw.Write([]byte(p.data))
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", "/", buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	inst := newTestInstance()
+	inst.workPath = dir
+	return createReqObj(inst, httptest.NewRecorder(), req)
+}
+
+// create temp work path
+func newUploadTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wframe-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// count spooled files
+func countUploadFiles(t *testing.T, dir string) int {
+	files, err := ioutil.ReadDir(filepath.Join(dir, uploadDefaultDir))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestUploadSpool(t *testing.T) {
+	dir := newUploadTestDir(t)
+	defer os.RemoveAll(dir)
+	srq := newUploadTestReq(dir, []uploadTestPart{
+		{"name", "", "bob"},
+		{"file", "a.txt", "content a"},
+		{"file", "b.txt", "content b"},
+	})
+	up, err := srq.ReadUpload(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Values.Get("name") != "bob" || len(up.Files["file"]) != 2 {
+		t.Fatalf("upload %v", up)
+	}
+	f := up.Files["file"][1]
+	data, err := ioutil.ReadFile(f.TempPath())
+	if err != nil || string(data) != "content b" || f.FileName != "b.txt" ||
+		f.Size != 9 {
+		t.Fatalf("file %+v, %q, %v", f, data, err)
+	}
+	if again, err := srq.ReadUpload(nil); err != nil || again != up {
+		t.Fatalf("second read %v", err)
+	}
+	if n := countUploadFiles(t, dir); n != 2 {
+		t.Fatalf("spooled %d files", n)
+	}
+	srq.(reqReleaser).release()
+	if n := countUploadFiles(t, dir); n != 0 {
+		t.Fatalf("%d files left after release", n)
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	dir := newUploadTestDir(t)
+	defer os.RemoveAll(dir)
+	big := strings.Repeat("x", 64)
+	for _, c := range []struct {
+		name  string
+		conf  *UploadConf
+		parts []uploadTestPart
+	}{
+		{"file size", &UploadConf{MaxFileSize: 32}, []uploadTestPart{
+			{"file", "a.txt", "small"}, {"file", "b.txt", big}}},
+		{"total size", &UploadConf{MaxTotalSize: 100}, []uploadTestPart{
+			{"file", "a.txt", big}, {"file", "b.txt", big}}},
+		{"parts", &UploadConf{MaxParts: 2}, []uploadTestPart{
+			{"file", "a.txt", "a"}, {"file", "b.txt", "b"},
+			{"name", "", "c"}}},
+	} {
+		srq := newUploadTestReq(dir, c.parts)
+		_, err := srq.ReadUpload(c.conf)
+		herr, ok := err.(*HTTPError)
+		if !ok || herr.StatusCode() != http.StatusRequestEntityTooLarge {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		// spooled files are removed when failed
+		if n := countUploadFiles(t, dir); n != 0 {
+			t.Fatalf("%s: %d files left", c.name, n)
+		}
+		// error is kept for later readers
+		if _, err := srq.ReadUpload(nil); err != herr {
+			t.Fatalf("%s: second read %v", c.name, err)
+		}
+	}
+}
+
+func TestUploadNotMultipart(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader("a=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	srq := createReqObj(newTestInstance(), httptest.NewRecorder(), req)
+	_, err := srq.ReadUpload(nil)
+	if herr, ok := err.(*HTTPError); !ok ||
+		herr.StatusCode() != http.StatusUnsupportedMediaType {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestUploadAfterBind(t *testing.T) {
+	dir := newUploadTestDir(t)
+	defer os.RemoveAll(dir)
+	srq := newUploadTestReq(dir, []uploadTestPart{
+		{"name", "", "bob"}, {"file", "a.txt", "content"}})
+	var dst struct {
+		Name string `form:"name"`
+	}
+	if err := srq.Bind(&dst); err != nil || dst.Name != "bob" {
+		t.Fatalf("bind %+v, %v", dst, err)
+	}
+	up, err := srq.ReadUpload(nil)
+	if err != nil || len(up.Files["file"]) != 1 {
+		t.Fatalf("upload %v, %v", up, err)
+	}
+	srq.(reqReleaser).release()
+}
@@ -0,0 +1,313 @@
+/* General Web framework
+ * declarative validation of request structs
+ * Qujie Tech 2019-08-23
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ValidateRule is a validate rule. val is the field value (pointer is
+// dereferenced, nil pointer is skipped except `required`), param is text after
+// '=' in tag. it return an error with message if validate failed
+type ValidateRule func(val reflect.Value, param string) error
+
+// ValidateFieldError is a failed field in validation
+type ValidateFieldError struct {
+	Field string // struct field path
+	Rule  string // failed rule
+	Msg   string // error message
+}
+
+// ValidateError is error of validation, it list every failed field. it is
+// responded as 422 by framework
+type ValidateError struct {
+	Fields []*ValidateFieldError
+}
+
+// registered rules
+var validateRules = struct {
+	lock  sync.RWMutex
+	rules map[string]ValidateRule
+}{rules: map[string]ValidateRule{
+	"required": validateRequired,
+	"min":      validateMin,
+	"max":      validateMax,
+	"len":      validateLen,
+	"pattern":  validatePattern,
+	"oneof":    validateOneOf,
+}}
+
+// compiled patterns
+var validatePatterns sync.Map
+
+// RegisterValidateRule register a custom rule for `validate` tag. rule with
+// same name is replaced
+func RegisterValidateRule(name string, rule ValidateRule) {
+	if name == "" || rule == nil {
+		panic("invalid validate rule")
+	}
+	validateRules.lock.Lock()
+	defer validateRules.lock.Unlock()
+	validateRules.rules[name] = rule
+}
+
+// get rule by name
+func getValidateRule(name string) ValidateRule {
+	validateRules.lock.RLock()
+	defer validateRules.lock.RUnlock()
+	return validateRules.rules[name]
+}
+
+// Validate check struct which v point to by `validate` tags, for example
+// `validate:"required,min=1,max=100"`. rules are separated by ',', so
+// `pattern` can not contain ','. error is *ValidateError if any field failed
+func Validate(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return errors.New("validate target is nil")
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return errors.New("validate target must be a struct")
+	}
+	verr := &ValidateError{}
+	validateStruct(rv, "", verr)
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validate fields of struct, nested struct is validated too
+func validateStruct(rv reflect.Value, prefix string, verr *ValidateError) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.PkgPath != "" && !sf.Anonymous { // unexported
+			continue
+		}
+		fv := rv.Field(i)
+		tag := sf.Tag.Get("validate")
+		if tag == "-" {
+			continue
+		}
+		if tag != "" {
+			validateField(fv, tag, prefix+sf.Name, verr)
+		}
+		for fv.Kind() == reflect.Ptr && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct && fv.Type() != bindTimeType {
+			validateStruct(fv, prefix+sf.Name+".", verr)
+		}
+	}
+}
+
+// validate a field by rules in tag
+func validateField(fv reflect.Value, tag string, field string,
+	verr *ValidateError) {
+	for _, rule := range strings.Split(tag, ",") {
+		name, param := rule, ""
+		if pos := strings.Index(rule, "="); pos >= 0 {
+			name, param = rule[:pos], rule[pos+1:]
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		check := getValidateRule(name)
+		if check == nil {
+			verr.Fields = append(verr.Fields, &ValidateFieldError{
+				field, name, "unknown validate rule"})
+			continue
+		}
+		val := fv
+		for val.Kind() == reflect.Ptr && !val.IsNil() {
+			val = val.Elem()
+		}
+		if val.Kind() == reflect.Ptr && name != "required" {
+			continue // nil pointer is optional
+		}
+		if err := check(val, param); err != nil {
+			verr.Fields = append(verr.Fields,
+				&ValidateFieldError{field, name, err.Error()})
+			// skip other rules if required failed
+			if name == "required" {
+				return
+			}
+		}
+	}
+}
+
+// numeric value or length of value
+func validateMeasure(val reflect.Value) (float64, bool, error) {
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int()), false, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return float64(val.Uint()), false, nil
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), false, nil
+	case reflect.String:
+		return float64(len([]rune(val.String()))), true, nil
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(val.Len()), true, nil
+	}
+	return 0, false, fmt.Errorf("rule is not applicable to %s", val.Type())
+}
+
+// parse numeric rule parameter
+func validateParam(param string) (float64, error) {
+	n, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rule parameter %q", param)
+	}
+	return n, nil
+}
+
+// rule `required`: value is not zero
+func validateRequired(val reflect.Value, param string) error {
+	if !val.IsValid() || val.IsZero() ||
+		(val.Kind() == reflect.Slice || val.Kind() == reflect.Map) &&
+			val.Len() == 0 {
+		return errors.New("is required")
+	}
+	return nil
+}
+
+// rule `min`: min number or length
+func validateMin(val reflect.Value, param string) error {
+	limit, err := validateParam(param)
+	if err != nil {
+		return err
+	}
+	n, isLen, err := validateMeasure(val)
+	if err != nil {
+		return err
+	}
+	if n < limit {
+		if isLen {
+			return fmt.Errorf("length must be at least %s", param)
+		}
+		return fmt.Errorf("must be at least %s", param)
+	}
+	return nil
+}
+
+// rule `max`: max number or length
+func validateMax(val reflect.Value, param string) error {
+	limit, err := validateParam(param)
+	if err != nil {
+		return err
+	}
+	n, isLen, err := validateMeasure(val)
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		if isLen {
+			return fmt.Errorf("length must be at most %s", param)
+		}
+		return fmt.Errorf("must be at most %s", param)
+	}
+	return nil
+}
+
+// rule `len`: exact length
+func validateLen(val reflect.Value, param string) error {
+	limit, err := validateParam(param)
+	if err != nil {
+		return err
+	}
+	n, isLen, err := validateMeasure(val)
+	if err != nil || !isLen {
+		return fmt.Errorf("rule is not applicable to %s", val.Type())
+	}
+	if n != limit {
+		return fmt.Errorf("length must be %s", param)
+	}
+	return nil
+}
+
+// rule `pattern`: string match regular expression
+func validatePattern(val reflect.Value, param string) error {
+	if val.Kind() != reflect.String {
+		return fmt.Errorf("rule is not applicable to %s", val.Type())
+	}
+	var re *regexp.Regexp
+	if cached, ok := validatePatterns.Load(param); ok {
+		re = cached.(*regexp.Regexp)
+	} else {
+		var err error
+		if re, err = regexp.Compile(param); err != nil {
+			return fmt.Errorf("invalid pattern %q", param)
+		}
+		validatePatterns.Store(param, re)
+	}
+	if !re.MatchString(val.String()) {
+		return fmt.Errorf("must match pattern %s", param)
+	}
+	return nil
+}
+
+// rule `oneof`: value in space separated list
+func validateOneOf(val reflect.Value, param string) error {
+	var s string
+	switch val.Kind() {
+	case reflect.String:
+		s = val.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		s = fmt.Sprint(val.Interface())
+	default:
+		return fmt.Errorf("rule is not applicable to %s", val.Type())
+	}
+	for _, opt := range strings.Fields(param) {
+		if s == opt {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of [%s]", param)
+}
+
+//////////////////// ValidateError methods ////////////////////
+
+// ValidateError: error message
+func (e *ValidateError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Field+": "+f.Msg)
+	}
+	return "validate failed: " + strings.Join(msgs, "; ")
+}
+
+// ValidateError: unprocessable entity
+func (e *ValidateError) StatusCode() int {
+	return http.StatusUnprocessableEntity
+}
+
+// ValidateError: field errors as problem details extension
+func (e *ValidateError) problemExt() map[string]interface{} {
+	fields := make([]map[string]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		fields = append(fields, map[string]string{
+			"field": f.Field, "rule": f.Rule, "message": f.Msg,
+		})
+	}
+	return map[string]interface{}{"errors": fields}
+}
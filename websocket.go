@@ -0,0 +1,552 @@
+/* General Web framework
+ * WebSocket session (RFC 6455)
+ * Qujie Tech 2019-07-18
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// magic GUID for Sec-WebSocket-Accept
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// default max size of received message
+const wsDefaultMaxMessage int64 = 1048576
+
+// WSMsgType is type of WebSocket data message
+type WSMsgType int
+
+// supported data message type
+const (
+	WSText   WSMsgType = 1
+	WSBinary WSMsgType = 2
+)
+
+// frame opcodes
+const (
+	wsOpCont   byte = 0x0
+	wsOpText   byte = 0x1
+	wsOpBinary byte = 0x2
+	wsOpClose  byte = 0x8
+	wsOpPing   byte = 0x9
+	wsOpPong   byte = 0xa
+)
+
+// WebSocket close codes
+const (
+	WSCloseNormal        = 1000
+	WSCloseGoingAway     = 1001
+	WSCloseProtocolError = 1002
+	WSCloseUnsupported   = 1003
+	WSCloseNoStatus      = 1005
+	WSCloseAbnormal      = 1006
+	WSCloseInvalidData   = 1007
+	WSClosePolicy        = 1008
+	WSCloseTooBig        = 1009
+	WSCloseInternal      = 1011
+)
+
+// ErrWSClosed is returned when operate a closed WebSocket connection
+var ErrWSClosed = errors.New("websocket connection closed")
+
+// WSConfig defined options of WebSocket session
+type WSConfig struct {
+	Subprotocols   []string              // supported subprotocols by priority
+	CheckOrigin    func(req SvrReq) bool // check `Origin`, nil allow all
+	MaxMessageSize int64                 // max received message size
+	WriteFragment  int                   // fragment size for sent message
+	PingInterval   time.Duration         // interval of server ping, 0 disable
+	PongWait       time.Duration         // read timeout, 0 disable
+	LogName        string                // logger name, default "error"
+}
+
+// WSCloseError is returned by ReadMessage when connection closed
+type WSCloseError struct {
+	Code   int
+	Reason string
+}
+
+// WSConn is a message-oriented WebSocket connection
+type WSConn struct {
+	conn     net.Conn
+	brw      *bufio.ReadWriter
+	req      SvrReq
+	conf     WSConfig
+	proto    string
+	log      func(level QLogLevel, msg string)
+	wlock    sync.Mutex // writer locker
+	closed   bool       // mark close frame sent
+	onPong   func(data []byte)
+	stopPing chan bool
+}
+
+// WebSocket upgrade session, it implement QSession
+type wsSession struct {
+	inst  QInstance
+	req   SvrReq
+	conf  WSConfig
+	serve func(conn *WSConn)
+	accpt string   // Sec-WebSocket-Accept value
+	proto string   // selected subprotocol
+	fail  QSession // error session if handshake failed
+}
+
+// CreateWebSocketSession create a session which upgrade request to WebSocket
+// and call serve with the connection. conf can be nil for default options
+func CreateWebSocketSession(inst QInstance, req SvrReq, conf *WSConfig,
+	serve func(conn *WSConn)) QSession {
+	ses := &wsSession{inst: inst, req: req, serve: serve}
+	if conf != nil {
+		ses.conf = *conf
+	}
+	if ses.conf.MaxMessageSize <= 0 {
+		ses.conf.MaxMessageSize = wsDefaultMaxMessage
+	}
+	if ses.conf.LogName == "" {
+		ses.conf.LogName = "error"
+	}
+	return ses
+}
+
+// CreateWebSocketHandle create a handle which serve each request as WebSocket
+func CreateWebSocketHandle(conf *WSConfig,
+	serve func(inst QInstance, req SvrReq, conn *WSConn)) QHandle {
+	return CreateSimpHandle(
+		func(inst QInstance, req SvrReq, env interface{}) QSession {
+			return CreateWebSocketSession(inst, req, conf, func(conn *WSConn) {
+				serve(inst, req, conn)
+			})
+		})
+}
+
+// check header contain a token in comma-separated list
+func headerHasToken(hdr http.Header, name, token string) bool {
+	for _, v := range hdr[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check close code received from client. codes which are reserved for
+// local use (1005, 1006, 1015) or not defined must not appear on the wire
+func wsValidCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code >= WSCloseNormal && code <= 1014:
+		return code != 1004 && code != WSCloseNoStatus &&
+			code != WSCloseAbnormal
+	}
+	return false
+}
+
+//////////////////// wsSession methods ////////////////////
+
+// wsSession: mark handshake failed
+func (ses *wsSession) reject(code int, msg string) {
+	ses.fail = CreateErrSession(code, msg, nil)
+	if rbses, ok := ses.fail.(reqBindSession); ok {
+		rbses.bindRequest(ses.req)
+	}
+}
+
+// wsSession: validate handshake
+func (ses *wsSession) EnterServer() (redirect string, err error) {
+	hdr := ses.req.Header()
+	if ses.req.Method() != MethodGET {
+		ses.reject(http.StatusMethodNotAllowed, "websocket require GET")
+		return "", nil
+	}
+	if !headerHasToken(hdr, "Connection", "upgrade") ||
+		!headerHasToken(hdr, "Upgrade", "websocket") {
+		ses.reject(http.StatusBadRequest, "not a websocket handshake")
+		return "", nil
+	}
+	if hdr.Get("Sec-WebSocket-Version") != "13" {
+		ses.reject(http.StatusUpgradeRequired, "unsupported websocket version")
+		return "", nil
+	}
+	key := strings.TrimSpace(hdr.Get("Sec-WebSocket-Key"))
+	if rawkey, err := base64.StdEncoding.DecodeString(key); err != nil ||
+		len(rawkey) != 16 {
+		ses.reject(http.StatusBadRequest, "invalid Sec-WebSocket-Key")
+		return "", nil
+	}
+	if ses.conf.CheckOrigin != nil && !ses.conf.CheckOrigin(ses.req) {
+		ses.reject(http.StatusForbidden, "origin not allowed")
+		return "", nil
+	}
+	if _, hijack, _ := rspFeatures(ses.req.rawRsp()); !hijack {
+		ses.reject(http.StatusInternalServerError, "connection can not hijack")
+		return "", nil
+	}
+	// select subprotocol
+	for _, offer := range strings.Split(hdr.Get("Sec-WebSocket-Protocol"), ",") {
+		offer = strings.TrimSpace(offer)
+		for _, sp := range ses.conf.Subprotocols {
+			if ses.proto == "" && offer == sp {
+				ses.proto = sp
+			}
+		}
+	}
+	acchash := sha1.Sum([]byte(key + wsAcceptGUID))
+	ses.accpt = base64.StdEncoding.EncodeToString(acchash[:])
+	return "", nil
+}
+
+// wsSession: switching protocols
+func (ses *wsSession) BeginResponse(header http.Header) (status int) {
+	if ses.fail != nil {
+		if status = ses.fail.BeginResponse(header); status ==
+			http.StatusUpgradeRequired {
+			header.Set("Sec-WebSocket-Version", "13")
+		}
+		return status
+	}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", ses.accpt)
+	if ses.proto != "" {
+		header.Set("Sec-WebSocket-Protocol", ses.proto)
+	}
+	return http.StatusSwitchingProtocols
+}
+
+// wsSession: hijack connection and serve it
+func (ses *wsSession) WriteResponse(rsp io.Writer) []byte {
+	if ses.fail != nil {
+		return ses.fail.WriteResponse(rsp)
+	}
+	sndlog := instLogger(ses.inst, ses.conf.LogName)
+	hj, ok := rsp.(http.Hijacker)
+	if !ok {
+		sndlog(LQLogERROR, "websocket: response can not hijack")
+		return nil
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		sndlog(LQLogERROR, fmt.Sprintf("websocket: hijack failed - %q", err))
+		return nil
+	}
+	wsconn := &WSConn{
+		conn:     conn,
+		brw:      brw,
+		req:      ses.req,
+		conf:     ses.conf,
+		proto:    ses.proto,
+		log:      sndlog,
+		stopPing: make(chan bool),
+	}
+	if reg, ok := ses.inst.(termRegister); ok {
+		cancel := reg.onTerminate(func() {
+			wsconn.Close(WSCloseGoingAway, "service terminated")
+		})
+		defer cancel()
+	}
+	defer wsconn.Close(WSCloseNormal, "")
+	defer (func() {
+		if err := recover(); err != nil {
+			sndlog(LQLogERROR, fmt.Sprintf("websocket: serve panic - %q", err))
+			wsconn.Close(WSCloseInternal, "")
+		}
+	})()
+	if ses.conf.PingInterval > 0 {
+		go wsconn.pingLoop()
+	}
+	ses.serve(wsconn)
+	return nil
+}
+
+//////////////////// WSCloseError methods ////////////////////
+
+// WSCloseError: error
+func (e *WSCloseError) Error() string {
+	return fmt.Sprintf("websocket closed %d %s", e.Code, e.Reason)
+}
+
+//////////////////// WSConn methods ////////////////////
+
+// Request get request object of the connection
+func (c *WSConn) Request() SvrReq {
+	return c.req
+}
+
+// Subprotocol get negotiated subprotocol
+func (c *WSConn) Subprotocol() string {
+	return c.proto
+}
+
+// SetPongHandler set callback for received pong
+func (c *WSConn) SetPongHandler(f func(data []byte)) {
+	c.onPong = f
+}
+
+// send ping periodic
+func (c *WSConn) pingLoop() {
+	for {
+		select {
+		case <-time.After(c.conf.PingInterval):
+			if err := c.Ping(nil); err != nil {
+				return
+			}
+		case <-c.stopPing:
+			return
+		}
+	}
+}
+
+// write a frame, server frames are never masked
+func (c *WSConn) writeFrame(fin bool, opcode byte, data []byte) error {
+	head := make([]byte, 2, 10)
+	head[0] = opcode
+	if fin {
+		head[0] |= 0x80
+	}
+	switch plen := len(data); {
+	case plen <= 125:
+		head[1] = byte(plen)
+	case plen <= 0xffff:
+		head[1] = 126
+		head = head[:4]
+		binary.BigEndian.PutUint16(head[2:], uint16(plen))
+	default:
+		head[1] = 127
+		head = head[:10]
+		binary.BigEndian.PutUint64(head[2:], uint64(plen))
+	}
+	if _, err := c.brw.Write(head); err != nil {
+		return err
+	}
+	if _, err := c.brw.Write(data); err != nil {
+		return err
+	}
+	return c.brw.Flush()
+}
+
+// write control frame
+func (c *WSConn) writeControl(opcode byte, data []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.closed {
+		return ErrWSClosed
+	}
+	if opcode == wsOpClose {
+		c.closed = true
+	}
+	return c.writeFrame(true, opcode, data)
+}
+
+// WriteMessage send a data message. message is fragmented if WriteFragment
+// configured
+func (c *WSConn) WriteMessage(mtype WSMsgType, data []byte) error {
+	if mtype != WSText && mtype != WSBinary {
+		return errors.New("unsupported websocket message type")
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.closed {
+		return ErrWSClosed
+	}
+	opcode := byte(mtype)
+	frag := c.conf.WriteFragment
+	for frag > 0 && len(data) > frag {
+		if err := c.writeFrame(false, opcode, data[:frag]); err != nil {
+			return err
+		}
+		opcode = wsOpCont
+		data = data[frag:]
+	}
+	return c.writeFrame(true, opcode, data)
+}
+
+// Ping send a ping frame
+func (c *WSConn) Ping(data []byte) error {
+	if len(data) > 125 {
+		return errors.New("websocket control frame too large")
+	}
+	return c.writeControl(wsOpPing, data)
+}
+
+// close connection without close frame
+func (c *WSConn) abort() {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.stopPing)
+	c.conn.Close()
+}
+
+// Close send close frame and close the connection. WSCloseAbnormal close
+// the connection without close frame
+func (c *WSConn) Close(code int, reason string) error {
+	if code == WSCloseAbnormal {
+		c.abort()
+		return nil
+	}
+	var payload []byte
+	if code != WSCloseNoStatus {
+		payload = make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+		if len(payload) > 125 {
+			payload = payload[:125]
+		}
+	}
+	err := c.writeControl(wsOpClose, payload)
+	if err == ErrWSClosed {
+		return nil
+	}
+	close(c.stopPing)
+	c.conn.Close()
+	return err
+}
+
+// close connection because protocol failed
+func (c *WSConn) fail(code int, reason string) error {
+	c.log(LQLogWARN, fmt.Sprintf("websocket: %s - %s", reason,
+		c.req.ClientIP()))
+	c.Close(code, reason)
+	return &WSCloseError{code, reason}
+}
+
+// read a frame from client
+func (c *WSConn) readFrame() (fin bool, opcode byte, data []byte, err error) {
+	if c.conf.PongWait > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.conf.PongWait))
+	}
+	head := make([]byte, 2, 8)
+	if _, err = io.ReadFull(c.brw, head); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		err = c.fail(WSCloseProtocolError, "reserved bits set")
+		return
+	}
+	if head[1]&0x80 == 0 {
+		err = c.fail(WSCloseProtocolError, "client frame not masked")
+		return
+	}
+	plen := int64(head[1] & 0x7f)
+	switch plen {
+	case 126:
+		if _, err = io.ReadFull(c.brw, head[:2]); err != nil {
+			return
+		}
+		plen = int64(binary.BigEndian.Uint16(head[:2]))
+	case 127:
+		head = head[:8]
+		if _, err = io.ReadFull(c.brw, head); err != nil {
+			return
+		}
+		plen = int64(binary.BigEndian.Uint64(head))
+	}
+	if opcode >= wsOpClose && (plen > 125 || !fin) {
+		err = c.fail(WSCloseProtocolError, "invalid control frame")
+		return
+	}
+	if plen < 0 || plen > c.conf.MaxMessageSize {
+		err = c.fail(WSCloseTooBig, "message too big")
+		return
+	}
+	mask := make([]byte, 4)
+	if _, err = io.ReadFull(c.brw, mask); err != nil {
+		return
+	}
+	data = make([]byte, plen)
+	if _, err = io.ReadFull(c.brw, data); err != nil {
+		return
+	}
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage read a data message. control frames are processed inside.
+// a *WSCloseError returned when connection closed
+func (c *WSConn) ReadMessage() (WSMsgType, []byte, error) {
+	var mtype WSMsgType
+	var msg []byte
+	for {
+		fin, opcode, data, err := c.readFrame()
+		if err != nil {
+			if _, ok := err.(*WSCloseError); !ok {
+				c.abort()
+			}
+			return 0, nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			c.writeControl(wsOpPong, data)
+			continue
+		case wsOpPong:
+			if c.onPong != nil {
+				c.onPong(data)
+			}
+			continue
+		case wsOpClose:
+			code, reason := WSCloseNoStatus, ""
+			if len(data) == 1 {
+				return 0, nil, c.fail(WSCloseProtocolError, "invalid close frame")
+			}
+			if len(data) >= 2 {
+				code = int(binary.BigEndian.Uint16(data))
+				reason = string(data[2:])
+				if !wsValidCloseCode(code) {
+					return 0, nil, c.fail(WSCloseProtocolError, "invalid close code")
+				}
+				if !utf8.ValidString(reason) {
+					return 0, nil, c.fail(WSCloseInvalidData, "invalid close reason")
+				}
+			}
+			c.Close(code, "")
+			return 0, nil, &WSCloseError{code, reason}
+		case wsOpText, wsOpBinary:
+			if mtype != 0 {
+				return 0, nil, c.fail(WSCloseProtocolError, "expect continuation")
+			}
+			mtype = WSMsgType(opcode)
+		case wsOpCont:
+			if mtype == 0 {
+				return 0, nil, c.fail(WSCloseProtocolError, "unexpect continuation")
+			}
+		default:
+			return 0, nil, c.fail(WSCloseProtocolError, "unknown opcode")
+		}
+		if int64(len(msg)+len(data)) > c.conf.MaxMessageSize {
+			return 0, nil, c.fail(WSCloseTooBig, "message too big")
+		}
+		msg = append(msg, data...)
+		if fin {
+			break
+		}
+	}
+	if mtype == WSText && !utf8.Valid(msg) {
+		return 0, nil, c.fail(WSCloseInvalidData, "invalid UTF-8 text")
+	}
+	return mtype, msg, nil
+}
@@ -0,0 +1,160 @@
+/* General Web framework
+ * tests of WebSocket session
+ * Qujie Tech 2019-09-05
+ * Fiathux Su
+ */
+
+package wframe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// WebSocket test client
+type wsTestClient struct {
+	conn net.Conn
+	brd  *bufio.Reader
+}
+
+// start a server which echo messages
+func newWSEchoServer() *httptest.Server {
+	_, hnd := newTestHandler(CreateWebSocketHandle(nil,
+		func(inst QInstance, req SvrReq, conn *WSConn) {
+			for {
+				mtype, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := conn.WriteMessage(mtype, msg); err != nil {
+					return
+				}
+			}
+		}))
+	return httptest.NewServer(hnd)
+}
+
+// dial server and finish handshake
+func dialWSTest(t *testing.T, svr *httptest.Server) *wsTestClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(svr.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /echo HTTP/1.1\r\n"+
+		"Host: test\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	brd := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(brd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status %d", rsp.StatusCode)
+	}
+	// accept value of the key in RFC 6455 example
+	if acc := rsp.Header.Get("Sec-WebSocket-Accept"); acc !=
+		"s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept %q", acc)
+	}
+	return &wsTestClient{conn, brd}
+}
+
+// wsTestClient: send a masked frame
+func (c *wsTestClient) send(t *testing.T, opcode byte, data []byte) {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(data))}
+	frame = append(frame, mask...)
+	for i, b := range data {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wsTestClient: receive an unmasked frame
+func (c *wsTestClient) recv(t *testing.T) (byte, []byte) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.brd, head); err != nil {
+		t.Fatal(err)
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatal("server frame is masked")
+	}
+	data := make([]byte, head[1]&0x7f)
+	if _, err := io.ReadFull(c.brd, data); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0f, data
+}
+
+// wsTestClient: send close frame and get close code of reply
+func (c *wsTestClient) close(t *testing.T, code int) int {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	c.send(t, wsOpClose, payload)
+	opcode, data := c.recv(t)
+	if opcode != wsOpClose || len(data) < 2 {
+		t.Fatalf("expect close frame, got opcode %d %q", opcode, data)
+	}
+	return int(binary.BigEndian.Uint16(data))
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	svr := newWSEchoServer()
+	defer svr.Close()
+	cli := dialWSTest(t, svr)
+	defer cli.conn.Close()
+	cli.send(t, wsOpText, []byte("hello"))
+	opcode, data := cli.recv(t)
+	if opcode != wsOpText || string(data) != "hello" {
+		t.Fatalf("echo opcode %d %q", opcode, data)
+	}
+	cli.send(t, wsOpPing, []byte("p"))
+	if opcode, data = cli.recv(t); opcode != wsOpPong || string(data) != "p" {
+		t.Fatalf("pong opcode %d %q", opcode, data)
+	}
+	if code := cli.close(t, WSCloseNormal); code != WSCloseNormal {
+		t.Fatalf("close code %d", code)
+	}
+	if _, err := cli.brd.ReadByte(); err != io.EOF {
+		t.Fatalf("connection not closed: %v", err)
+	}
+}
+
+func TestWebSocketInvalidCloseCode(t *testing.T) {
+	svr := newWSEchoServer()
+	defer svr.Close()
+	for _, code := range []int{0, 999, 1004, WSCloseNoStatus,
+		WSCloseAbnormal, 1015, 2000, 5000} {
+		cli := dialWSTest(t, svr)
+		if reply := cli.close(t, code); reply != WSCloseProtocolError {
+			t.Errorf("close code %d replied %d", code, reply)
+		}
+		cli.conn.Close()
+	}
+}
+
+func TestWebSocketHandshakeReject(t *testing.T) {
+	svr := newWSEchoServer()
+	defer svr.Close()
+	rsp, err := http.Get(svr.URL + "/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d", rsp.StatusCode)
+	}
+}